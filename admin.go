@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"./pg"
+	"./pgwal"
+)
+
+// pumpCmd is an admin action for the pump, the result is sent on Reply
+type pumpCmd struct {
+	Op    string // base, switch, pause, resume
+	Reply chan error
+}
+
+// command hands op to the pump of a running pipeline
+func (a *Agent) command(op string) error {
+	c := &pumpCmd{Op: op, Reply: make(chan error, 1)}
+	select {
+	case a.cmdC <- c:
+	case <-time.After(10 * time.Second):
+		return errors.New("the pipeline is not running")
+	}
+	select {
+	case err := <-c.Reply:
+		return err
+	case <-time.After(time.Minute):
+		return errors.New("no reply from the pipeline")
+	}
+}
+
+// switchWAL has the server switch to a new wal segment, so the current one
+// is streamed complete and uploaded
+func (a *Agent) switchWAL() (string, error) {
+	conn, err := pg.NewConn(a.ConnString)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	v, err := serverVersion(conn)
+	if err != nil {
+		return "", err
+	}
+	q := "select pg_switch_xlog()::text"
+	if v >= 100000 {
+		q = "select pg_switch_wal()::text"
+	}
+	rows, err := conn.SimpleQuery(q)
+	if err != nil {
+		return "", err
+	}
+	lsn, _ := rows[0][0].(string)
+	return lsn, nil
+}
+
+// adminState is the pipeline state of an agent for /state
+type adminState struct {
+	Cluster      string     `json:"cluster,omitempty"`
+	Streaming    bool       `json:"streaming"`
+	Paused       bool       `json:"paused"`
+	WALReceived  string     `json:"wal-received"`
+	WALStored    string     `json:"wal-stored"`
+	UploadLag    uint64     `json:"upload-lag"` // bytes
+	UploadQueue  int        `json:"upload-queue"`
+	SpoolObjects int        `json:"spool-objects"`
+	SpoolBytes   int64      `json:"spool-bytes"`
+	Base         *baseState `json:"base,omitempty"` // running
+	LastBase     *time.Time `json:"last-base,omitempty"`
+	Restarts     uint64     `json:"restarts"`
+	StreamStarts uint64     `json:"stream-starts"`
+}
+
+type baseState struct {
+	Name     string    `json:"name"`
+	Lsn      string    `json:"lsn"`
+	Started  time.Time `json:"started"`
+	Read     int64     `json:"read"`
+	Size     int64     `json:"size,omitempty"` // estimate with base-progress
+	Progress string    `json:"progress"`
+}
+
+func (a *Agent) adminState() *adminState {
+	s := &adminState{Cluster: a.Name}
+	m := a.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.Streaming, s.Paused = m.streaming, m.paused
+	s.WALReceived = pgwal.LSN(m.received).String()
+	s.WALStored = pgwal.LSN(m.stored).String()
+	if m.received > m.stored {
+		s.UploadLag = m.received - m.stored
+	}
+	s.UploadQueue = len(m.uploadC)
+	if m.spool != nil {
+		s.SpoolObjects, s.SpoolBytes = m.spool.Stats()
+	}
+	if b := m.base; b != nil {
+		read := atomic.LoadInt64(&b.read)
+		s.Base = &baseState{b.Name, pgwal.LSN(b.Lsn).String(), b.Time, read, b.Size, baseProgress(read, b.Size)}
+	}
+	if !m.baseLast.IsZero() {
+		t := m.baseLast.UTC()
+		s.LastBase = &t
+	}
+	s.Restarts, s.StreamStarts = m.restarts, m.streams
+	return s
+}
+
+// serveAdmin serves the admin api of agents at addr, unix:/path for a unix
+// socket or a localhost port. It has no authentication.
+//
+//	GET  /health  200 while the process serves requests
+//	GET  /ready   200 once every cluster is streaming
+//	GET  /state   pipeline state as json
+//	POST /base    start a base backup now
+//	POST /switch  switch the server to a new wal segment
+//	POST /pause   stop streaming, the slot keeps the wal up to slot-max-wal
+//	POST /resume  start streaming again
+//
+// With several clusters, ?cluster=name selects one for the actions.
+func serveAdmin(addr string, agents []*Agent) error {
+	var l net.Listener
+	var err error
+	if strings.HasPrefix(addr, "unix:") {
+		path := strings.TrimPrefix(addr, "unix:")
+		os.Remove(path) // of an earlier run
+		l, err = net.Listen("unix", path)
+		if err == nil {
+			err = os.Chmod(path, 0660)
+		}
+	} else {
+		var host string
+		host, _, err = net.SplitHostPort(addr)
+		if err == nil && host != "localhost" && !net.ParseIP(host).IsLoopback() {
+			err = fmt.Errorf("admin-listen %s: only unix sockets and localhost", addr)
+		}
+		if err == nil {
+			l, err = net.Listen("tcp", addr)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		var msg []string
+		for _, a := range agents {
+			if s := a.adminState(); s.Paused {
+				msg = append(msg, strings.TrimSpace(a.Name+" paused"))
+			} else if !s.Streaming {
+				msg = append(msg, strings.TrimSpace(a.Name+" not streaming"))
+			}
+		}
+		if len(msg) > 0 {
+			http.Error(w, strings.Join(msg, ", "), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		var l []*adminState
+		for _, a := range agents {
+			l = append(l, a.adminState())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		b, _ := json.MarshalIndent(l, "", "  ")
+		w.Write(append(b, '\n'))
+	})
+	for _, op := range []string{"base", "switch", "pause", "resume"} {
+		op := op
+		mux.HandleFunc("/"+op, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "POST only", http.StatusMethodNotAllowed)
+				return
+			}
+			a, err := adminAgent(agents, r.URL.Query().Get("cluster"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			err = a.command(op)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		})
+	}
+
+	log.Print("admin: listening on ", l.Addr())
+	go func() {
+		log.Print("admin: ", http.Serve(l, mux))
+	}()
+	return nil
+}
+
+func adminAgent(agents []*Agent, name string) (*Agent, error) {
+	if name == "" && len(agents) == 1 {
+		return agents[0], nil
+	}
+	for _, a := range agents {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	if name == "" {
+		return nil, errors.New("several clusters, select one with ?cluster=name")
+	}
+	return nil, errors.New("no cluster " + strconv.Quote(name))
+}
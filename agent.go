@@ -1,12 +1,22 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"./pg"
@@ -15,32 +25,114 @@ import (
 
 func (a *Agent) Agent() error {
 
+	sp, err := openSpool(a.spoolDir(), int64(a.SpoolSize)<<20)
+	if err != nil {
+		return err
+	}
+	a.spool = sp
+	a.walStored = &walTracker{}
+	a.blocks = newBlockTracker()
+	if a.uploadSem == nil {
+		a.uploadSem, a.uploadRate = newUploadLimits(a.UploadWorkers, a.UploadRate)
+	}
+	a.store.(*cryptStore).Rate = a.uploadRate
+
+	// systemd stops the agent with SIGTERM
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigC)
+
+	tag := "agent: "
+	if a.Name != "" {
+		tag = "agent " + a.Name + ": "
+	}
+
+	var fails int // restarts without running properly in between
 	for {
 		a.pgb = &http.Client{}
 		a.exitC = make(chan bool)
 		a.uploadC = make(chan *Upload, 16)
 		a.txLogC = make(chan []byte, 16)
+		a.metrics.pipeline(a.spool, a.uploadC, a.txLogC)
 
-		wc := make(chan bool)
+		log.Print(tag, "starting")
+		started := time.Now()
+		running := map[string]bool{"txlog": true, "upload": true, "pump": true, "retention": true}
+		wc := make(chan string, len(running))
 		go run("txlog", a.TxSender, wc)
 		go run("upload", a.Uploader, wc)
 		go run("pump", a.Pump, wc)
-		<-wc
+		go run("retention", a.Pruner, wc)
+
+		var stop bool
+		select {
+		case sig := <-sigC:
+			log.Print(tag, sig, ", stopping")
+			stop = true
+		case <-a.stopC:
+			log.Print(tag, "stopping")
+			stop = true
+		case name := <-wc:
+			delete(running, name)
+			log.Print(tag, name, " exited, stopping")
+		}
 		close(a.exitC)
-		log.Fatal("bye")
-		<-wc
-		<-wc
-		time.Sleep(2 * time.Second)
+
+		// the pump spools the wal received so far, uploads in flight are
+		// spooled already
+		timeoutC := time.After(time.Minute)
+	wait:
+		for len(running) > 0 {
+			select {
+			case name := <-wc:
+				delete(running, name)
+			case sig := <-sigC:
+				log.Print(tag, sig, " again, not waiting for ", names(running))
+				stop = true
+				break wait
+			case <-timeoutC:
+				log.Print(tag, "not waiting any longer for ", names(running))
+				break wait
+			}
+		}
+		a.drainUploads()
+
+		if stop {
+			log.Print(tag, "stopped")
+			return nil
+		}
+
+		if time.Since(started) > 10*time.Minute {
+			fails = 0 // it ran fine for a while
+		}
+		fails++
+		a.metrics.restart()
+		if fails > maxRestarts {
+			return fmt.Errorf("failed %d times in a row, giving up", fails)
+		}
+		d := backoff(fails-1, 5*time.Minute)
+		log.Print(tag, "restarting in ", d.Truncate(time.Second), " (", fails, "/", maxRestarts, ")")
+		select {
+		case sig := <-sigC:
+			log.Print(tag, sig, ", stopped")
+			return nil
+		case <-a.stopC:
+			log.Print(tag, "stopped")
+			return nil
+		case <-time.After(d):
+		}
 	}
 }
 
-func run(name string, f func() error, wc chan bool) {
+const maxRestarts = 10
+
+func run(name string, f func() error, wc chan string) {
 	defer func() {
 		if rvr := recover(); rvr != nil {
 			log.Print(name, ": ", rvr, " (panic)")
 			debug.PrintStack()
 		}
-		wc <- true
+		wc <- name
 	}()
 
 	err := f()
@@ -49,6 +141,33 @@ func run(name string, f func() error, wc chan bool) {
 	}
 }
 
+func names(m map[string]bool) []string {
+	var l []string
+	for n := range m {
+		l = append(l, n)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// drainUploads spools what was still queued for upload when the pipeline
+// stopped
+func (a *Agent) drainUploads() {
+	for {
+		select {
+		case u := <-a.uploadC:
+			err := a.spool.Keep(u.Name, u.Body)
+			if err != nil {
+				log.Print("agent: dropping ", u.Name, ": ", err)
+			} else {
+				log.Print("agent: spooled ", u.Name)
+			}
+		default:
+			return
+		}
+	}
+}
+
 const (
 	walSegmentSize  = 0x1000000  // 16MB, compressed ~5MB
 	baseSegmentSize = 0x10000000 // 256MB, compressed ~50MB
@@ -72,7 +191,21 @@ func (a *Agent) Pump() error {
 	if err != nil {
 		return err
 	}
-	defer walConn.Close()
+	defer func() {
+		walConn.Close() // replaced when the slot is dropped
+	}()
+
+	// a slot keeps the server from recycling wal the agent hasn't stored
+	slot := a.Slot
+	if slot != "" {
+		created, err := walConn.CreateReplicationSlot(slot)
+		if err != nil {
+			return err
+		}
+		if created {
+			log.Print("slot: created replication slot ", slot)
+		}
+	}
 
 	baseConn, err := pg.NewConn(a.ConnString + " replication=true")
 	if err != nil {
@@ -80,9 +213,75 @@ func (a *Agent) Pump() error {
 	}
 	defer baseConn.Close()
 
+	// wal a previous run journaled but couldn't upload
+	err = a.spoolJournal()
+	if err == errExit {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// in synchronous mode wal is reported flushed once journaled, the agent
+	// can then be a synchronous standby (application_name in conn-string)
+	flushed := a.walStored.Safe
+	var journal *walJournal
+	if a.Synchronous {
+		journal, err = openJournal(a.journalPath())
+		if err != nil {
+			return err
+		}
+		defer journal.Close()
+		flushed = journal.Flushed
+		log.Print("sync: reporting wal flushed once journaled in ", a.journalPath())
+	}
+
 	var forceNewBase bool
+	var forceBase string // reason, from the admin api
+
+	// a base backup goes on across restarts of the stream, baseConn can
+	// only run one at a time
+	var baseDoneC <-chan error // set while a base backup is running
+	var running *baseInfo
+	baseDone := func() {
+		baseDoneC = nil
+		a.blocks.Drop(running.Gen)
+		a.writeBaseStatus(nil)
+		a.metrics.baseRunning(nil)
+		a.metrics.baseDone(running.Time)
+	}
+
+	a.writeBaseStatus(nil) // of an earlier run
+	defer a.metrics.streamState(false, false)
+
+	// on the way out, spool the wal received since the last segment, the
+	// server may recycle it before the agent is back
+	var partial func() *Upload
+	defer func() {
+		if partial == nil {
+			return
+		}
+		if u := partial(); u != nil {
+			err := a.spool.Keep(u.Name, u.Body)
+			if err != nil {
+				log.Print("pump: dropping ", u.Name, ": ", err)
+			} else {
+				log.Print("pump: spooled ", u.Name)
+			}
+		}
+	}()
+
+	// the goroutines of the replication stream, stopped on every restart
+	var streamStopC chan bool
+	stopStream := func() {
+		if streamStopC != nil {
+			close(streamStopC)
+			streamStopC = nil
+		}
+	}
+	defer stopStream()
 
 restart:
+	stopStream()
 
 	systemID, timeline, dbLsn, err := walConn.IdentifySystem()
 	if err != nil {
@@ -93,46 +292,95 @@ restart:
 		return fmt.Errorf("systemID mismatch; known=%s database=%d", a.GUID, systemID)
 	}
 
+	hist, err := a.fetchHistory(walConn, timeline)
+	if err == errExit {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// the tx sender starts over with the stream. Changed blocks are only
+	// known from wal followed without gaps, the tracker is reset here and
+	// not by the tx sender, which may get to it after a base began.
+	a.blocks.Reset()
+	select {
+	case <-a.exitC:
+		return nil
+	case a.txLogC <- nil:
+	}
+
 	var walLsn uint64      // next wal lsn
 	var baseLsn uint64     // last base lsn
 	var baseTime time.Time // last base time
+	var lastBase *baseInfo // last complete base
 	if !forceNewBase {
 		// scan files and find latest wal position and base backup
-		files, err := a.store.List()
-		if err != nil {
-			return err
-		}
-
-		for _, f := range files {
+		// spooled objects count as stored, they will be uploaded. Wal and
+		// bases of other timelines only count up to where the current one
+		// branched off.
+		scan := func(f *StoreFile) error {
 			var lsn0 uint64
 			var timeline0 int
 			var time0 uint64
 			fmt.Sscanf(f.Name, "%012x.%x.%x.", &lsn0, &timeline0, &time0)
-			if strings.HasSuffix(f.Name, ".wal") && timeline0 != 0 && timeline0 <= timeline {
+			if strings.HasSuffix(f.Name, ".wal") && timeline0 != 0 && timeline0 == hist.segment(lsn0) && lsn0+walSegmentSize > walLsn {
 				walLsn = lsn0 + walSegmentSize
-			} else if strings.HasSuffix(f.Name, ".base") && time0 != 0 && timeline0 <= timeline {
+			} else if strings.HasSuffix(f.Name, ".base") && time0 != 0 && hist.contains(timeline0, lsn0) && lsn0 >= baseLsn {
 				baseLsn = lsn0
 				baseTime = time.Unix(int64(time0), 0)
+				lastBase = &baseInfo{Name: f.Name, Lsn: lsn0}
+			}
+			return nil
+		}
+		var stored []uint64 // wal segments in the store, in lsn order
+		err := a.store.List("", func(f *StoreFile) error {
+			var lsn0 uint64
+			var timeline0 int
+			fmt.Sscanf(f.Name, "%012x.%x.", &lsn0, &timeline0)
+			if strings.HasSuffix(f.Name, ".wal") && timeline0 != 0 && timeline0 == hist.segment(lsn0) {
+				stored = append(stored, lsn0)
 			}
+			return scan(f)
+		})
+		if err != nil {
+			return err
 		}
+		// segments complete out of order, wal is stored only up to the
+		// first one missing since the last base. Spooled ones are done
+		// once uploaded.
+		from := baseLsn & ^uint64(walSegmentSize-1)
+		if baseLsn == 0 && len(stored) > 0 {
+			from = stored[0]
+		}
+		a.walStored.Seed(from, stored)
+		a.spool.List(scan)
 	}
 
-	var baseC <-chan []byte
-	var basePart int
-	if baseLsn == 0 || walLsn == 0 {
-		_, lsn0, c, err := baseConn.BaseBackup("pgbackup", 0)
-		if err != nil {
-			return err
+	if baseDoneC != nil && (baseLsn == 0 || walLsn == 0) {
+		log.Print("baseBackup@", pgwal.LSN(running.Lsn), " waiting for it to finish before a new base")
+		select {
+		case <-a.exitC:
+			return nil
+		case err := <-baseDoneC:
+			if err != nil {
+				return err
+			}
+			baseDone()
 		}
-		lsn1, err := pgwal.ParseLSN(lsn0)
+	} else if baseDoneC != nil {
+		baseLsn, baseTime = running.Lsn, running.Time
+	}
+
+	if baseLsn == 0 || walLsn == 0 {
+		running, baseDoneC, err = a.startBase(baseConn, timeline, nil)
 		if err != nil {
 			return err
 		}
 
-		baseLsn = uint64(lsn1)
+		baseLsn = running.Lsn
 		walLsn = baseLsn & ^uint64(walSegmentSize-1)
-		baseC = c
-		baseTime = time.Now().UTC()
+		baseTime = running.Time
+		a.walStored.Reset(walLsn)
 
 		log.Print("newBackup base:", pgwal.LSN(baseLsn), "  wal:", pgwal.LSN(walLsn), "  server:", dbLsn, "  system:", systemID)
 
@@ -140,18 +388,74 @@ restart:
 		log.Print("continue wal:", pgwal.LSN(walLsn), "  lastBase:", pgwal.LSN(baseLsn), " (", time.Since(baseTime).Truncate(time.Second), " ago)  server:", dbLsn, "  system:", systemID)
 	}
 
-	walC, err := walConn.StartReplication(pgwal.LSN(walLsn).String(), timeline)
+	streamStopC = make(chan bool)
+	walC, err := walConn.StartReplication(slot, pgwal.LSN(walLsn).String(), timeline, flushed, streamStopC)
 	if err != nil {
 		return err
 	}
+	a.metrics.walReset(walLsn)
+	a.metrics.streamStart()
+	a.metrics.streamState(true, false)
+	if !baseTime.IsZero() && baseDoneC == nil {
+		a.metrics.baseDone(baseTime)
+	}
+	if journal != nil {
+		// on a restart the journal holds wal already reported flushed
+		err = a.spoolJournal()
+		if err == errExit {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		err = journal.Reset(walLsn, hist.segment(walLsn), nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	var walBuf []byte  // piece to upload
+	var partialLen int // of the last partial upload of walBuf
+	partial = func() *Upload {
+		if len(walBuf) == 0 || len(walBuf) == partialLen {
+			return nil
+		}
+		return &Upload{
+			Name: fmt.Sprintf("%012x.%x.%08x.partial", walLsn, hist.segment(walLsn), len(walBuf)),
+			Body: bytes.NewReader(walBuf),
+		}
+	}
 
-	var walBuf, baseBuf []byte // pieces to upload
+	// slot-max-wal is also checked apart from the stream, the pump stops
+	// reading it while the spool is full
+	var valveC <-chan uint64
+	if slot != "" && a.SlotMaxWAL > 0 {
+		valveC = a.slotValve(streamStopC)
+	}
+	valve := func(lag uint64) error {
+		log.Print("slot: ", lag>>20, "MB of wal not stored, more than slot-max-wal ", a.SlotMaxWAL, "MB, dropping slot ", slot)
+		conn, err := a.dropSlot(walConn, slot)
+		if err != nil {
+			return err
+		}
+		walConn = conn
+		// without the slot until the agent restarts, wal the server
+		// recycles in the meantime forces a new base
+		slot = ""
+		walBuf = nil
+		return nil
+	}
 
+	var paused bool
 	var rolloverT <-chan time.Time
 	if a.Rollover > 0 {
 		rolloverT = time.After(time.Duration(a.Rollover) * time.Second)
 	}
 
+	// the base schedule is checked on every wal message, and every minute
+	// on a quiet database
+	scheduleT := time.NewTicker(time.Minute)
+	defer scheduleT.Stop()
+
 	for {
 		var upload *Upload
 		select {
@@ -159,6 +463,13 @@ restart:
 			return nil
 
 		case d := <-walC:
+			if d.Data == nil && walConn.Err() == nil {
+				// a standby we stream from was promoted or followed a new
+				// timeline, continue on that one
+				tl, lsn := walConn.NextTimeline()
+				log.Print("timeline: ", timeline, " ended at ", lsn, ", switching to ", tl)
+				goto restart
+			}
 			if d.Data == nil {
 				// indicates wal part is no longer available
 				forceNewBase = true
@@ -168,89 +479,502 @@ restart:
 
 			forceNewBase = false
 
+			if slot != "" && a.SlotMaxWAL > 0 && d.ServerLsn > a.walStored.Safe()+uint64(a.SlotMaxWAL)<<20 {
+				err = valve(d.ServerLsn - a.walStored.Safe())
+				if err != nil {
+					return err
+				}
+				goto restart
+			}
+
 			if d.Lsn != walLsn+uint64(len(walBuf)) {
 				return fmt.Errorf("weirdNextLsn=%d expected=%d+%d", d.Lsn, walLsn, len(walBuf))
 			}
 
 			walBuf = append(walBuf, d.Data...)
+			a.metrics.walReceived(d.Lsn + uint64(len(d.Data)))
+			if journal != nil && len(walBuf) < walSegmentSize {
+				err = journal.Append(d.Data)
+				if err != nil {
+					return err
+				}
+			}
 			if len(walBuf) >= walSegmentSize {
 				upload = &Upload{
-					Name: fmt.Sprintf("%012x.%x.wal", walLsn, timeline),
+					Name: fmt.Sprintf("%012x.%x.wal", walLsn, hist.segment(walLsn)),
 					Body: bytes.NewReader(walBuf[:walSegmentSize]),
 				}
 				walLsn += uint64(walSegmentSize)
 				walBuf = walBuf[walSegmentSize:]
+				partialLen = 0
 				if a.Rollover > 0 {
 					rolloverT = time.After(time.Duration(a.Rollover) * time.Second)
 				}
 			}
 
+			if journal != nil {
+				if upload != nil {
+					// the segment must be on disk before the journal moves on
+					err = a.spool.Put(upload.Name, upload.Body, a.exitC)
+					if err == errExit {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					upload = nil
+					err = journal.Reset(walLsn, hist.segment(walLsn), walBuf)
+					if err != nil {
+						return err
+					}
+				}
+				// commits on the server wait for this
+				walConn.StandbyStatus(false)
+			}
+
 			select {
 			case <-a.exitC:
 				return nil
+			case lag := <-valveC:
+				err = valve(lag)
+				if err != nil {
+					return err
+				}
+				goto restart
 			case a.txLogC <- d.Data:
 			}
 
-		case d := <-baseC:
-			if d == nil {
-				upload = &Upload{
-					Name: fmt.Sprintf("%012x.%x.%x.base", baseLsn, timeline, baseTime.Unix()),
-					Body: bytes.NewReader(baseBuf),
-				}
-				basePart++
-				log.Print("baseBackupDone chunks:", basePart)
-				baseC = nil
-				baseBuf = nil
-				basePart = 0
-				// keep baseTime as "time of last base backup"
-				break
-			}
-			baseBuf = append(baseBuf, d...)
-			if len(baseBuf) >= baseSegmentSize {
-				upload = &Upload{
-					Name: fmt.Sprintf("%012x.%x.%x.base.part%x", baseLsn, timeline, baseTime.Unix(), basePart),
-					Body: bytes.NewReader(baseBuf[:baseSegmentSize]),
-				}
-				baseBuf = baseBuf[baseSegmentSize:]
-				basePart++
+		case lag := <-valveC:
+			err = valve(lag)
+			if err != nil {
+				return err
+			}
+			goto restart
+
+		case err := <-baseDoneC:
+			if err != nil {
+				return err
 			}
+			// keep baseTime as "time of last base backup"
+			lastBase = running
+			baseDone()
 
 		case <-rolloverT:
-			if baseC == nil {
-				// Hmm, it would be nicer if we could somehow trigger switch using the
-				// baseConn. Perhaps issue a new base backup and cancel it right away?
-				rolloverConn, err := pg.NewConn(a.ConnString)
-				if rolloverConn != nil {
-					rolloverConn.SimpleQuery("select pg_switch_xlog()")
-					log.Print("xlog-rollover ", a.Rollover, "s after last segment")
-					rolloverConn.Close()
-				} else {
-					log.Print("xlog-rollover: failed, err=", err)
+			// upload the tail of the current segment, the full segment
+			// supersedes it later
+			if upload = partial(); upload != nil {
+				partialLen = len(walBuf)
+			}
+			rolloverT = time.After(time.Duration(a.Rollover) * time.Second)
+
+		case <-scheduleT.C:
+			if baseDoneC != nil {
+				log.Print("baseBackup@", pgwal.LSN(running.Lsn), " progress ", running.progress())
+				a.writeBaseStatus(running)
+			}
+
+		case c := <-a.cmdC:
+			switch c.Op {
+			case "base":
+				if baseDoneC != nil {
+					c.Reply <- errors.New("a base backup is running")
+					break
+				}
+				forceBase = "admin"
+				c.Reply <- nil
+
+			case "switch":
+				go func() {
+					lsn, err := a.switchWAL()
+					if err == nil {
+						log.Print("admin: switched wal at ", lsn)
+					}
+					c.Reply <- err
+				}()
+
+			case "pause":
+				if baseDoneC != nil {
+					c.Reply <- errors.New("a base backup is running")
+					break
+				}
+				if journal != nil {
+					// a synchronous standby not streaming blocks commits
+					c.Reply <- errors.New("can't pause in synchronous mode")
+					break
+				}
+				// spool the tail like on exit, the stream starts over at
+				// the segment on resume
+				if upload = partial(); upload != nil {
+					partialLen = len(walBuf)
 				}
+				stopStream()
+				walConn.Close()
+				a.metrics.streamState(false, true)
+				log.Print("admin: streaming paused at ", pgwal.LSN(walLsn+uint64(len(walBuf))))
+				c.Reply <- nil
+				paused = true
+
+			default:
+				c.Reply <- errors.New("streaming is not paused")
 			}
 		}
 		if upload != nil {
 			select {
 			case <-a.exitC:
 				return nil
+			case lag := <-valveC:
+				err = valve(lag)
+				if err != nil {
+					return err
+				}
+				goto restart
 			case a.uploadC <- upload:
 			}
 		}
 
-		if baseC == nil && (time.Since(baseTime) > 4*time.Hour) {
-			_, lsn0, c, err := baseConn.BaseBackup("pgbackup", 0)
+		if paused {
+			// the slot keeps the wal on the server meanwhile, without one
+			// what it recycles forces a new base. The valve stopped with
+			// the stream, slot-max-wal still applies.
+			pauseStopC := make(chan bool)
+			var pauseValveC <-chan uint64
+			if slot != "" && a.SlotMaxWAL > 0 {
+				pauseValveC = a.slotValve(pauseStopC)
+			}
+			for paused {
+				select {
+				case <-a.exitC:
+					close(pauseStopC)
+					return nil
+				case lag := <-pauseValveC:
+					err = valve(lag)
+					if err != nil {
+						close(pauseStopC)
+						return err
+					}
+					walConn.Close() // resume connects anew
+					pauseValveC = nil
+				case c := <-a.cmdC:
+					if c.Op == "resume" {
+						paused = false
+						c.Reply <- nil
+					} else {
+						c.Reply <- errors.New("streaming is paused")
+					}
+				}
+			}
+			close(pauseStopC)
+			walConn, err = pg.NewConn(a.ConnString + " replication=true")
+			if err != nil {
+				return err
+			}
+			log.Print("admin: streaming resumed")
+			walBuf = nil
+			goto restart
+		}
+
+		var walSize uint64 // since the last base
+		if end := walLsn + uint64(len(walBuf)); end > baseLsn {
+			walSize = end - baseLsn
+		}
+		reason := a.baseDue(time.Now(), baseTime, walSize)
+		if forceBase != "" {
+			reason, forceBase = forceBase, ""
+		}
+		if baseDoneC == nil && reason != "" {
+			running, baseDoneC, err = a.startBase(baseConn, timeline, lastBase)
 			if err != nil {
 				return err
 			}
-			lsn1, err := pgwal.ParseLSN(lsn0)
+			baseLsn = running.Lsn
+			baseTime = running.Time
+			log.Print("baseBackup@", pgwal.LSN(baseLsn), " at ", baseTime, " (", reason, ")")
+		}
+	}
+}
+
+// dropSlot drops the slot streamed from conn, it returns a new connection
+// in place of conn
+func (a *Agent) dropSlot(conn *pg.Conn, slot string) (*pg.Conn, error) {
+	// the slot can only be dropped once the wal sender using it has exited
+	conn.Close()
+	conn, err := pg.NewConn(a.ConnString + " replication=true")
+	if err != nil {
+		return nil, err
+	}
+	for try := 0; ; try++ {
+		err = conn.DropReplicationSlot(slot)
+		if err == nil || try == 10 || !strings.Contains(err.Error(), "is active") {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// slotValve checks every minute how much wal the server has that isn't
+// stored, the amount is sent once it is more than slot-max-wal
+func (a *Agent) slotValve(stopC <-chan bool) <-chan uint64 {
+	valveC := make(chan uint64, 1)
+	go func() {
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		for {
+			select {
+			case <-stopC:
+				return
+			case <-t.C:
+			}
+			lsn, err := a.serverLsn()
+			if err != nil {
+				log.Print("slot: ", err)
+				continue
+			}
+			if stored := a.walStored.Safe(); lsn > stored+uint64(a.SlotMaxWAL)<<20 {
+				valveC <- lsn - stored
+				return
+			}
+		}
+	}()
+	return valveC
+}
+
+// serverLsn queries the wal position of the server on a connection of its
+// own, the replication one may be blocked
+func (a *Agent) serverLsn() (uint64, error) {
+	conn, err := pg.NewConn(a.ConnString)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	v, err := serverVersion(conn)
+	if err != nil {
+		return 0, err
+	}
+	q := "select (case when pg_is_in_recovery() then pg_last_xlog_replay_location() else pg_current_xlog_location() end)::text"
+	if v >= 100000 {
+		q = "select (case when pg_is_in_recovery() then pg_last_wal_replay_lsn() else pg_current_wal_lsn() end)::text"
+	}
+	rows, err := conn.SimpleQuery(q)
+	if err != nil {
+		return 0, err
+	}
+	s, _ := rows[0][0].(string)
+	lsn, err := pgwal.ParseLSN(s)
+	return uint64(lsn), err
+}
+
+// serverVersion returns server_version_num, eg 90605 or 100004
+func serverVersion(conn *pg.Conn) (int, error) {
+	rows, err := conn.SimpleQuery("SHOW server_version_num")
+	if err != nil {
+		return 0, err
+	}
+	s, _ := rows[0][0].(string)
+	return strconv.Atoi(s)
+}
+
+// baseInfo is a base backup, changed blocks are only known for bases taken
+// since the stream (re)started
+type baseInfo struct {
+	read   int64 // atomic, bytes of the tar stream so far
+	Size   int64 // estimated bytes with base-progress, else 0
+	Name   string
+	Lsn    uint64
+	Time   time.Time
+	Gen    uint64    // blocks changed since the base started, 0 if unknown
+	Parent *baseInfo // for an incremental base
+	Chain  int       // incrementals since the full base
+
+	limit *limitedReader // reads of a base started outside base-max-rate-window
+}
+
+// startBase begins a base backup, incremental on top of parent if
+// base-incremental allows
+func (a *Agent) startBase(conn *pg.Conn, timeline int, parent *baseInfo) (*baseInfo, <-chan error, error) {
+	// before the backup starts, so the changes cover all wal after its lsn
+	gen := a.blocks.Begin()
+	opts := a.baseBackupOpts(time.Now())
+	if opts.MaxRate > 0 {
+		log.Print("baseBackup: max-rate ", opts.MaxRate, "kB/s")
+	}
+	_, lsn0, tablespaces, archC, err := conn.BaseBackup(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	lsn1, err := pgwal.ParseLSN(lsn0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	b := &baseInfo{Lsn: uint64(lsn1), Time: time.Now().UTC(), Gen: gen}
+	b.Name = fmt.Sprintf("%012x.%x.%x.base", b.Lsn, timeline, b.Time.Unix())
+	if a.BaseIncremental > 0 && parent != nil && parent.Gen != 0 && parent.Chain < a.BaseIncremental {
+		b.Parent = parent
+		b.Name = incrementalBaseName(b.Lsn, timeline, b.Time.Unix(), parent.Lsn)
+	}
+	for _, ts := range tablespaces {
+		if ts.Size < 0 {
+			b.Size = 0 // no estimate
+			break
+		}
+		b.Size += ts.Size << 10
+	}
+	if opts.MaxRate == 0 && a.BaseMaxRate > 0 {
+		// reading slower makes the server send slower
+		b.limit = &limitedReader{L: &rateLimiter{rate: float64(a.BaseMaxRate) * 1024}, Windows: a.baseRateWindow}
+	}
+	a.metrics.baseRunning(b)
+	return b, a.uploadBase(b, archC, conn), nil
+}
+
+// progress tells how far the base backup got
+func (b *baseInfo) progress() string {
+	return baseProgress(atomic.LoadInt64(&b.read), b.Size)
+}
+
+func baseProgress(read, size int64) string {
+	s := fmt.Sprint(read>>20, "MB")
+	if size > 0 {
+		pct := read * 100 / size
+		if pct > 99 {
+			pct = 99 // the estimate is rough
+		}
+		s += fmt.Sprint(" of ~", size>>20, "MB (", pct, "%)")
+	}
+	return s
+}
+
+// uploadBase spools a base backup for upload while the pump goes on with
+// the wal. The data directory is stored as name.partN objects of at most
+// baseSegmentSize, other tablespaces as name.tblspc.OID.partN, followed by
+// the name object marking the base as complete. It holds the manifest,
+// or is empty for a full base of just the data directory. The result is
+// sent on the returned channel.
+func (a *Agent) uploadBase(b *baseInfo, archC <-chan *pg.BaseArchive, conn *pg.Conn) <-chan error {
+	doneC := make(chan error, 1)
+	go func() {
+		var m baseManifest
+		var g *blockGen
+		if b.Parent != nil {
+			// the blocks changed since the parent started, up to our start
+			g = a.blocks.Changes(b.Parent.Gen, b.Lsn, a.exitC)
+			if g != nil {
+				b.Chain = b.Parent.Chain + 1
+				m = baseManifest{Parent: b.Parent.Name, Incremental: true, Chain: b.Chain}
+			} else {
+				// the name still has the parent, retention then keeps it a
+				// little longer than needed
+				log.Print("baseBackup: changed blocks unknown, taking a full base")
+				b.Parent = nil
+			}
+		}
+
+		var parts int
+		for ar := range archC {
+			name := b.Name
+			if ar.OID != 0 {
+				name = fmt.Sprintf("%s.tblspc.%d", b.Name, ar.OID)
+				m.Tablespaces = append(m.Tablespaces, baseTablespace{OID: ar.OID, Location: ar.Location})
+			}
+			var r io.Reader = &baseReader{C: ar.C, Conn: conn, N: &b.read}
+			if b.limit != nil {
+				b.limit.R = r
+				r = b.limit
+			}
+			n, err := a.uploadArchive(name, r, g, ar.OID)
+			parts += n
 			if err != nil {
+				doneC <- err
+				return
+			}
+		}
+		if err := conn.Err(); err != nil {
+			doneC <- err
+			return
+		}
+
+		var manifest []byte
+		if m.Parent != "" || len(m.Tablespaces) > 0 {
+			manifest, _ = json.Marshal(&m)
+		}
+		err := a.spool.Put(b.Name, bytes.NewReader(manifest), a.exitC)
+		if err == nil {
+			if m.Parent != "" {
+				log.Print("baseBackupDone parts:", parts, " tablespaces:", len(m.Tablespaces), " incremental on ", m.Parent)
+			} else {
+				log.Print("baseBackupDone parts:", parts, " tablespaces:", len(m.Tablespaces))
+			}
+		}
+		doneC <- err
+	}()
+	return doneC
+}
+
+// uploadArchive spools the tar stream of a tablespace as name.partN, with
+// only the blocks changed in g if set. It returns the number of parts.
+func (a *Agent) uploadArchive(name string, r io.Reader, g *blockGen, tblspc uint32) (int, error) {
+	if g != nil {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func(r io.Reader) {
+			pw.CloseWithError(filterIncremental(r, pw, g, tblspc))
+		}(r)
+		r = pr
+	}
+
+	br := bufio.NewReaderSize(r, 64<<10)
+	var part int
+	for {
+		_, err := br.Peek(1)
+		if err == io.EOF {
+			return part, nil
+		} else if err != nil {
+			return part, err
+		}
+		err = a.spool.Put(fmt.Sprintf("%s.part%x", name, part), &io.LimitedReader{R: br, N: baseSegmentSize}, a.exitC)
+		if err != nil {
+			return part, err
+		}
+		part++
+	}
+}
+
+// baseReader reads a tar stream of a running base backup
+type baseReader struct {
+	C    <-chan []byte
+	Conn *pg.Conn
+	N    *int64 // atomic, bytes read
+	buf  []byte
+}
+
+// fill waits for more data, it returns io.EOF once the archive completed
+func (r *baseReader) fill() error {
+	for len(r.buf) == 0 {
+		d, ok := <-r.C
+		if !ok {
+			if err := r.Conn.Err(); err != nil {
 				return err
 			}
-			baseLsn = uint64(lsn1)
-			baseC = c
-			baseTime = time.Now().UTC()
-			log.Print("baseBackup@", pgwal.LSN(baseLsn), " at ", baseTime)
-			rolloverT = nil // reset rollover timer
+			return io.EOF
 		}
+		r.buf = d
+	}
+	return nil
+}
+
+func (r *baseReader) Read(d []byte) (int, error) {
+	err := r.fill()
+	if err != nil {
+		return 0, err
+	}
+	n := copy(d, r.buf)
+	r.buf = r.buf[n:]
+	if r.N != nil {
+		atomic.AddInt64(r.N, int64(n))
 	}
+	return n, nil
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"./pgwal"
+)
+
+// blockTracker follows the relation blocks the wal changes, for incremental
+// bases. Changes are collected in generations, each started before a base
+// backup, so an incremental base stores what changed since its parent.
+type blockTracker struct {
+	mu      sync.Mutex
+	seen    uint64 // wal parsed up to
+	gens    map[uint64]*blockGen
+	changeC chan bool // closed and replaced when seen advances
+}
+
+// relKey is a relation file, the main fork
+type relKey struct {
+	Tblspc, DB, Rel uint32
+}
+
+// blockGen is the set of blocks changed since a generation started
+type blockGen struct {
+	blocks map[relKey][]uint64 // bit set by block number
+	rels   map[relKey]bool     // changed without block references
+	dbs    map[relKey]bool     // Rel 0, databases created
+}
+
+const (
+	relSegBlocks = 0x20000 // blocks per 1GB relation segment file
+	blockSize    = 8192
+)
+
+func newBlockTracker() *blockTracker {
+	return &blockTracker{
+		gens:    map[uint64]*blockGen{},
+		changeC: make(chan bool),
+	}
+}
+
+// Reset drops all generations, the wal is no longer followed continuously
+func (t *blockTracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gens = map[uint64]*blockGen{}
+	t.seen = 0
+}
+
+// Begin starts a generation of changes, identified by the returned id. A
+// base started after Begin covers everything up to its start lsn.
+func (t *blockTracker) Begin() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := uint64(time.Now().UnixNano())
+	t.gens[id] = &blockGen{
+		blocks: map[relKey][]uint64{},
+		rels:   map[relKey]bool{},
+		dbs:    map[relKey]bool{},
+	}
+	return id
+}
+
+// Drop forgets the generations started before id
+func (t *blockTracker) Drop(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id0 := range t.gens {
+		if id0 < id {
+			delete(t.gens, id0)
+		}
+	}
+}
+
+// Record adds the changes of r to all generations. Records may be added
+// more than once.
+func (t *blockTracker) Record(r *pgwal.Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.gens) == 0 {
+		return
+	}
+
+	bb, ok := r.Blocks()
+	if !ok {
+		// block references may be missing, no generation is complete
+		t.gens = map[uint64]*blockGen{}
+		t.seen = 0
+		return
+	}
+	for _, b := range bb {
+		if b.Fork != 0 {
+			continue // other forks are stored whole
+		}
+		k := relKey{b.Tblspc, b.DB, b.Rel}
+		for _, g := range t.gens {
+			bs := g.blocks[k]
+			for int(b.Block/64) >= len(bs) {
+				bs = append(bs, 0)
+			}
+			bs[b.Block/64] |= 1 << (b.Block % 64)
+			g.blocks[k] = bs
+		}
+	}
+
+	// files written without block references
+	main := r.MainData()
+	info := r.Info & 0xf0
+	if r.Rmgr == pgwal.RmgrSmgr && info == 0x10 && len(main) >= 12 {
+		// XLOG_SMGR_CREATE
+		k := relKey{r.Uint32(main[0:4]), r.Uint32(main[4:8]), r.Uint32(main[8:12])}
+		for _, g := range t.gens {
+			g.rels[k] = true
+		}
+	} else if r.Rmgr == pgwal.RmgrDbase && info == 0x00 && len(main) >= 8 {
+		// XLOG_DBASE_CREATE: db, tablespace
+		k := relKey{Tblspc: r.Uint32(main[4:8]), DB: r.Uint32(main[0:4])}
+		for _, g := range t.gens {
+			g.dbs[k] = true
+		}
+	}
+}
+
+// Seen records that the wal up to lsn was parsed
+func (t *blockTracker) Seen(lsn uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if lsn > t.seen {
+		t.seen = lsn
+		close(t.changeC)
+		t.changeC = make(chan bool)
+	}
+}
+
+// Changes returns a copy of generation id once the wal up to lsn was
+// parsed, or nil if there is no such generation or the wait times out
+func (t *blockTracker) Changes(id, lsn uint64, exitC <-chan bool) *blockGen {
+	timeoutC := time.After(5 * time.Minute)
+	for {
+		t.mu.Lock()
+		g, ok := t.gens[id]
+		if !ok {
+			t.mu.Unlock()
+			return nil
+		}
+		if t.seen >= lsn {
+			defer t.mu.Unlock()
+			return g.copy()
+		}
+		changeC := t.changeC
+		t.mu.Unlock()
+
+		select {
+		case <-exitC:
+			return nil
+		case <-timeoutC:
+			return nil
+		case <-changeC:
+		}
+	}
+}
+
+func (g *blockGen) copy() *blockGen {
+	c := &blockGen{
+		blocks: map[relKey][]uint64{},
+		rels:   map[relKey]bool{},
+		dbs:    map[relKey]bool{},
+	}
+	for k, bs := range g.blocks {
+		c.blocks[k] = append([]uint64{}, bs...)
+	}
+	for k := range g.rels {
+		c.rels[k] = true
+	}
+	for k := range g.dbs {
+		c.dbs[k] = true
+	}
+	return c
+}
+
+// Whole returns whether the relation has to be stored completely
+func (g *blockGen) Whole(k relKey) bool {
+	return g.rels[k] || g.dbs[relKey{Tblspc: k.Tblspc, DB: k.DB}]
+}
+
+// Changed returns whether the block of relation k changed
+func (g *blockGen) Changed(k relKey, block uint32) bool {
+	bs := g.blocks[k]
+	return int(block/64) < len(bs) && bs[block/64]&(1<<(block%64)) != 0
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// names end up in paths and restore_command
+var clusterName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// readClusters sets up an agent per entry of clusters, over the settings
+// of the config. The backup id, guid and encrypt keys are not inherited,
+// each cluster is a backup of its own. PGBACKUP_CLUSTER=name selects one of
+// them for commands working on a single cluster.
+func (a *Agent) readClusters(data []byte) error {
+	names := map[string]bool{}
+	for i, raw := range a.Clusters {
+		c := &Agent{}
+		err := json.Unmarshal(data, c)
+		if err != nil {
+			return err
+		}
+		c.Clusters = nil
+		c.BackupID, c.GUID = 0, ""
+		c.EncryptKey, c.EncryptKeys, c.EncryptKeyID = "", nil, 0
+		c.EncryptPublicKey, c.EncryptPrivateKey = "", ""
+		err = json.Unmarshal(raw, c)
+		if err != nil {
+			return fmt.Errorf("cluster %d: %s", i, err)
+		}
+		if !clusterName.MatchString(c.Name) || names[c.Name] {
+			return fmt.Errorf("cluster %d: needs a unique name of letters, digits, - and _", i)
+		}
+		names[c.Name] = true
+		if c.BackupID == 0 || c.GUID == "" || (c.EncryptKey == "" && len(c.EncryptKeys) == 0 && c.EncryptPublicKey == "") {
+			return fmt.Errorf("cluster %s: needs its own id, guid and encrypt key", c.Name)
+		}
+
+		c.configFile = a.configFile
+		c.inCluster = true
+		c.pgb = &http.Client{}
+		if c.Store == a.Store && c.StorePrefix == a.StorePrefix {
+			c.StorePrefix = path.Join(a.StorePrefix, c.Name)
+		}
+		if c.SpoolDir == a.SpoolDir {
+			c.SpoolDir = filepath.Join(a.spoolDir(), c.Name)
+		}
+		err = c.configure()
+		if err != nil {
+			return fmt.Errorf("cluster %s: %s", c.Name, err)
+		}
+		a.clusters = append(a.clusters, c)
+	}
+
+	name := os.Getenv("PGBACKUP_CLUSTER")
+	if name == "" && len(a.clusters) == 1 {
+		name = a.clusters[0].Name
+	}
+	if name == "" {
+		return nil
+	}
+	for _, c := range a.clusters {
+		if c.Name == name {
+			*a = *c
+			return nil
+		}
+	}
+	return fmt.Errorf("no cluster %s in %s", name, a.configFile)
+}
+
+// AgentClusters runs the agent of each cluster, sharing upload-workers and
+// upload-rate. Once one gives up the others are stopped too, the process
+// exits and the service manager restarts it.
+func (a *Agent) AgentClusters() error {
+	sem, rate := newUploadLimits(a.UploadWorkers, a.UploadRate)
+	stopC := make(chan bool)
+	errC := make(chan error, len(a.clusters))
+	for _, c := range a.clusters {
+		c.uploadSem, c.uploadRate, c.stopC = sem, rate, stopC
+		log.Print("agent: cluster ", c.Name, " store ", c.Store, " prefix ", c.StorePrefix, " spool ", c.spoolDir())
+		go func(c *Agent) {
+			err := c.Agent()
+			if err != nil {
+				err = fmt.Errorf("cluster %s: %s", c.Name, err)
+			}
+			errC <- err
+		}(c)
+	}
+
+	var err error
+	for range a.clusters {
+		if err0 := <-errC; err0 != nil && err == nil {
+			err = err0
+			log.Print("agent: ", err, ", stopping all clusters")
+			close(stopC)
+		}
+	}
+	return err
+}
+
+// newUploadLimits returns the semaphore for n concurrent uploads and the
+// limiter for rate KB/s, nil for no limit
+func newUploadLimits(n, rate int) (chan bool, *rateLimiter) {
+	if n <= 0 {
+		n = 4
+	}
+	var l *rateLimiter
+	if rate > 0 {
+		l = &rateLimiter{rate: float64(rate) * 1024}
+	}
+	return make(chan bool, n), l
+}
+
+// rateLimiter shares a rate in bytes per second between readers
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate float64
+	next time.Time // when the bytes read so far are paid for
+}
+
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+type limitedReader struct {
+	R       io.Reader
+	L       *rateLimiter
+	Windows []timeWindow // limited only within, if set
+}
+
+func (r *limitedReader) Read(d []byte) (int, error) {
+	if len(d) > 32<<10 {
+		d = d[:32<<10] // smooth
+	}
+	n, err := r.R.Read(d)
+	if len(r.Windows) == 0 || inWindows(r.Windows, time.Now().Local()) {
+		r.L.wait(n)
+	}
+	return n, err
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codecs compress object bodies, the codec is recorded in the object
+// header as one of these bytes
+const (
+	codecGzip = 'g'
+	codecZstd = 'z'
+	codecLZ4  = 'l'
+	codecNone = 'n'
+)
+
+// codecBlock is the block size for compressing on all cores
+const codecBlock = 1 << 20
+
+func parseCodec(s string) (byte, error) {
+	switch s {
+	case "", "gzip":
+		return codecGzip, nil
+	case "zstd":
+		return codecZstd, nil
+	case "lz4":
+		return codecLZ4, nil
+	case "none":
+		return codecNone, nil
+	}
+	return 0, fmt.Errorf("unknown codec %q, use gzip, zstd, lz4 or none", s)
+}
+
+// compressWriter compresses to w, with parallel on all cores
+func compressWriter(codec byte, w io.Writer, parallel bool) (io.WriteCloser, error) {
+	switch codec {
+	case codecGzip:
+		if parallel {
+			// gzip members concatenate into one valid stream
+			return newBlockWriter(w, func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }), nil
+		}
+		return gzip.NewWriter(w), nil
+	case codecZstd:
+		n := 1
+		if parallel {
+			n = runtime.NumCPU()
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(n))
+	case codecLZ4:
+		lw := lz4.NewWriter(w)
+		if parallel {
+			err := lw.Apply(lz4.ConcurrencyOption(runtime.NumCPU()))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return lw, nil
+	case codecNone:
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", codec)
+}
+
+// decompressReader reads what compressWriter wrote
+func decompressReader(codec byte, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case codecGzip:
+		return gzip.NewReader(r)
+	case codecZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case codecLZ4:
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	case codecNone:
+		return ioutil.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("unknown codec %q", codec)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// blockWriter compresses blocks of codecBlock bytes on all cores, each as
+// a complete stream, and writes them to W in order
+type blockWriter struct {
+	W   io.Writer
+	New func(io.Writer) io.WriteCloser
+
+	buf    []byte
+	n      int
+	queueC chan chan []byte // compressed blocks, in order
+	doneC  chan bool
+
+	mu  sync.Mutex
+	err error
+}
+
+func newBlockWriter(w io.Writer, fn func(io.Writer) io.WriteCloser) *blockWriter {
+	bw := &blockWriter{
+		W:      w,
+		New:    fn,
+		queueC: make(chan chan []byte, runtime.NumCPU()),
+		doneC:  make(chan bool),
+	}
+	go bw.writer()
+	return bw
+}
+
+func (bw *blockWriter) writer() {
+	defer close(bw.doneC)
+	for resC := range bw.queueC {
+		b := <-resC
+		if bw.error() != nil {
+			continue // drain
+		}
+		_, err := bw.W.Write(b)
+		if err != nil {
+			bw.mu.Lock()
+			bw.err = err
+			bw.mu.Unlock()
+		}
+	}
+}
+
+func (bw *blockWriter) error() error {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return bw.err
+}
+
+func (bw *blockWriter) Write(d []byte) (int, error) {
+	var o int
+	for len(d) > 0 {
+		if err := bw.error(); err != nil {
+			return o, err
+		}
+		if bw.buf == nil {
+			bw.buf = make([]byte, 0, codecBlock)
+		}
+		n := copy(bw.buf[len(bw.buf):cap(bw.buf)], d)
+		bw.buf = bw.buf[:len(bw.buf)+n]
+		d = d[n:]
+		o += n
+		if len(bw.buf) == cap(bw.buf) {
+			bw.flush()
+		}
+	}
+	return o, nil
+}
+
+// flush compresses the buffered block, it waits while all cores are busy
+func (bw *blockWriter) flush() {
+	block := bw.buf
+	bw.buf = nil
+	bw.n++
+
+	resC := make(chan []byte, 1)
+	bw.queueC <- resC
+	go func() {
+		var b bytes.Buffer
+		w := bw.New(&b)
+		w.Write(block) // writing to a bytes.Buffer doesn't fail
+		w.Close()
+		resC <- b.Bytes()
+	}()
+}
+
+func (bw *blockWriter) Close() error {
+	if len(bw.buf) > 0 || bw.n == 0 {
+		bw.flush()
+	}
+	close(bw.queueC)
+	<-bw.doneC
+	return bw.error()
+}
@@ -1,34 +1,200 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
+	"bufio"
+	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
 )
 
+// cryptStore compresses and encrypts objects.
+//
+// Objects start with a header: "PGBK", a version byte, a uint16 length and
+// that many bytes of fields, each a tag byte, a length byte and the value:
+//
+//	's' random salt
+//	'k' id of the store key, uint32 (0 if missing)
+//	'e' ephemeral X25519 public key, for objects encrypted to a public key
+//	'r' fingerprint of the recipient public key
+//	'c' codec of the body, see codec.go (gzip if missing)
+//
+// The rest is the compressed body in chunks of cryptChunk bytes, each sealed
+// with AES-GCM. The key is derived from a secret, the header and the object
+// name, so every upload gets its own key and objects can't be swapped. The
+// secret is the store key, or with a public key it is derived from the
+// X25519 exchange of a new ephemeral key with the recipient key. Nonces
+// count the chunks and flag the last one, so reordered or truncated
+// objects don't decrypt.
+//
+// Objects without the header are from older agents: gzip encrypted with
+// AES-CTR with key 0, the iv derived from the name. These are still read.
 type cryptStore struct {
 	Store
-	Aes cipher.Block
+	Keys  map[int][]byte // by key id
+	KeyID int            // key for new objects
+
+	WALCodec  byte // codecs for new objects, gzip if 0
+	BaseCodec byte
+
+	// with Public set, new objects are encrypted to it instead and can only
+	// be read with the Private key. The agent doesn't need the latter.
+	Public  *ecdh.PublicKey
+	Private *ecdh.PrivateKey
+
+	// Rate limits the compressed and encrypted bytes uploaded, if set
+	Rate *rateLimiter
 }
 
-func (s cryptStore) stream(name string) cipher.Stream {
+const (
+	cryptMagic   = "PGBK"
+	cryptVersion = 1
+	cryptChunk   = 64 << 10
+)
+
+var errCrypt = errors.New("crypt: corrupt or truncated object")
+
+func (s cryptStore) stream(name string) (cipher.Stream, error) {
+	key, ok := s.Keys[0]
+	if !ok {
+		return nil, errors.New("crypt: legacy object needs encrypt key 0")
+	}
+	b, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
 	iv := sha256.Sum256(([]byte)(name))
-	return cipher.NewCTR(s.Aes, iv[:16])
+	return cipher.NewCTR(b, iv[:16]), nil
+}
+
+// secret returns the secret of an object with the header fields
+func (s cryptStore) secret(fields map[byte][]byte) ([]byte, error) {
+	eph := fields['e']
+	if eph == nil {
+		key, ok := s.Keys[keyID(fields)]
+		if !ok {
+			return nil, fmt.Errorf("crypt: no encrypt key with id %d", keyID(fields))
+		}
+		return key, nil
+	}
+
+	if s.Private == nil {
+		return nil, errors.New("crypt: object is encrypted to a public key, encrypt-private-key is needed")
+	}
+	pub := s.Private.PublicKey()
+	if string(fields['r']) != string(keyFingerprint(pub)) {
+		return nil, errors.New("crypt: object is encrypted to a different public key")
+	}
+	epub, err := ecdh.X25519().NewPublicKey(eph)
+	if err != nil {
+		return nil, errCrypt
+	}
+	shared, err := s.Private.ECDH(epub)
+	if err != nil {
+		return nil, err
+	}
+	return x25519Secret(shared, eph, pub.Bytes()), nil
+}
+
+func x25519Secret(shared, eph, recipient []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("pgbackup x25519"))
+	h.Write(shared)
+	h.Write(eph)
+	h.Write(recipient)
+	return h.Sum(nil)
+}
+
+func keyFingerprint(pub *ecdh.PublicKey) []byte {
+	h := sha256.Sum256(pub.Bytes())
+	return h[:8]
+}
+
+func (s cryptStore) aead(name string, header []byte, secret []byte) (cipher.AEAD, error) {
+	m := hmac.New(sha256.New, secret)
+	m.Write(header)
+	m.Write([]byte(name))
+	b, err := aes.NewCipher(m.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
 }
 
 func (s cryptStore) Upload(name string, body io.Reader) error {
-	buf := &bytes.Buffer{}
-	var w io.Writer
-	w = &cipher.StreamWriter{W: buf, S: s.stream(name)}
-	w = gzip.NewWriter(w)
-	_, err := io.Copy(w, body)
+	salt := make([]byte, 32)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	codec := s.BaseCodec
+	if strings.HasSuffix(name, ".wal") || strings.HasSuffix(name, ".partial") {
+		codec = s.WALCodec
+	}
+	if codec == 0 {
+		codec = codecGzip
+	}
+	fields := map[byte][]byte{'s': salt, 'c': {codec}}
+	var secret []byte
+	if s.Public != nil {
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		shared, err := eph.ECDH(s.Public)
+		if err != nil {
+			return err
+		}
+		fields['e'] = eph.PublicKey().Bytes()
+		fields['r'] = keyFingerprint(s.Public)
+		secret = x25519Secret(shared, fields['e'], s.Public.Bytes())
+	} else {
+		fields['k'] = make([]byte, 4)
+		binary.BigEndian.PutUint32(fields['k'], uint32(s.KeyID))
+		secret = s.Keys[s.KeyID]
+	}
+	header := cryptHeader(fields)
+	aead, err := s.aead(name, header, secret)
 	if err != nil {
 		return err
 	}
-	w.(*gzip.Writer).Close()
-	return s.Store.Upload(name, buf)
+
+	// compress and encrypt while uploading, nothing is buffered as a whole
+	pr, pw := io.Pipe()
+	go func() {
+		sw := &sealWriter{W: pw, AEAD: aead}
+		var w io.WriteCloser
+		_, err := pw.Write(header)
+		if err == nil {
+			// base parts are big enough to be worth all cores
+			w, err = compressWriter(codec, sw, strings.Contains(name, ".base."))
+		}
+		if err == nil {
+			_, err = io.Copy(w, body)
+			if err1 := w.Close(); err == nil {
+				err = err1
+			}
+		}
+		if err == nil {
+			err = sw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	var r io.Reader = pr
+	if s.Rate != nil {
+		r = &limitedReader{R: pr, L: s.Rate}
+	}
+	err = s.Store.Upload(name, r)
+	pr.CloseWithError(err) // stops the writer if the upload failed early
+	return err
 }
 
 func (s cryptStore) Download(name string) (io.ReadCloser, error) {
@@ -38,25 +204,227 @@ func (s cryptStore) Download(name string) (io.ReadCloser, error) {
 	}
 
 	var r0 io.Reader
-	r0 = &cipher.StreamReader{R: r, S: s.stream(name)}
-	r0, err = gzip.NewReader(r0)
+	codec := byte(codecGzip)
+	br := bufio.NewReader(r)
+	header, fields, err := peekCryptHeader(br)
+	if c := fields['c']; len(c) == 1 {
+		codec = c[0]
+	}
+	if err == nil && header != nil {
+		var secret []byte
+		var aead cipher.AEAD
+		secret, err = s.secret(fields)
+		if err == nil {
+			aead, err = s.aead(name, header, secret)
+		}
+		r0 = &openReader{R: br, AEAD: aead}
+	} else if err == nil {
+		var cs cipher.Stream
+		cs, err = s.stream(name)
+		r0 = &cipher.StreamReader{R: br, S: cs}
+	}
+	var dr io.ReadCloser
+	if err == nil {
+		dr, err = decompressReader(codec, r0)
+	}
 	if err != nil {
 		r.Close()
 		return nil, err
 	}
 
 	r = &otherCloser{
-		Reader: r0,
+		Reader: dr,
 		Closer: r,
+		Inner:  dr,
 	}
 	return r, nil
 }
 
+// ObjectKey describes the key an object is encrypted with
+func (s cryptStore) ObjectKey(name string) (string, error) {
+	r, err := s.Store.Download(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	_, fields, err := peekCryptHeader(bufio.NewReader(r))
+	if fields['e'] != nil {
+		return fmt.Sprintf("public key %x", fields['r']), err
+	}
+	return fmt.Sprintf("key %d", keyID(fields)), err
+}
+
+// ActiveKey describes the key new objects are encrypted with
+func (s cryptStore) ActiveKey() string {
+	if s.Public != nil {
+		return fmt.Sprintf("public key %x", keyFingerprint(s.Public))
+	}
+	return fmt.Sprintf("key %d", s.KeyID)
+}
+
+func keyID(fields map[byte][]byte) int {
+	if k := fields['k']; len(k) == 4 {
+		return int(binary.BigEndian.Uint32(k))
+	}
+	return 0
+}
+
+// cryptHeader encodes the object header for fields
+func cryptHeader(fields map[byte][]byte) []byte {
+	var b []byte
+	for _, tag := range []byte{'s', 'k', 'e', 'r', 'c'} {
+		if v, ok := fields[tag]; ok {
+			b = append(b, tag, byte(len(v)))
+			b = append(b, v...)
+		}
+	}
+	h := append([]byte(cryptMagic), cryptVersion, 0, 0)
+	binary.BigEndian.PutUint16(h[len(h)-2:], uint16(len(b)))
+	return append(h, b...)
+}
+
+// peekCryptHeader reads the header if there is one, a legacy object gives
+// a nil header and is left unread
+func peekCryptHeader(br *bufio.Reader) ([]byte, map[byte][]byte, error) {
+	m, _ := br.Peek(len(cryptMagic) + 1)
+	if len(m) < len(cryptMagic)+1 || string(m[:len(cryptMagic)]) != cryptMagic {
+		return nil, nil, nil
+	}
+	if m[len(cryptMagic)] != cryptVersion {
+		return nil, nil, fmt.Errorf("crypt: unsupported object version %d", m[len(cryptMagic)])
+	}
+	return readCryptHeader(br)
+}
+
+// readCryptHeader returns the raw header and its fields
+func readCryptHeader(r io.Reader) ([]byte, map[byte][]byte, error) {
+	h := make([]byte, len(cryptMagic)+3)
+	_, err := io.ReadFull(r, h)
+	if err != nil {
+		return nil, nil, err
+	}
+	n := int(binary.BigEndian.Uint16(h[len(h)-2:]))
+	h = append(h, make([]byte, n)...)
+	_, err = io.ReadFull(r, h[len(h)-n:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields := map[byte][]byte{}
+	b := h[len(h)-n:]
+	for len(b) > 0 {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, nil, errCrypt
+		}
+		fields[b[0]] = b[2 : 2+b[1]]
+		b = b[2+b[1]:]
+	}
+	return h, fields, nil
+}
+
+// chunkNonce is the chunk counter followed by a flag for the last chunk
+func chunkNonce(nonce []byte, n uint64, last bool) []byte {
+	for i := range nonce {
+		nonce[i] = 0
+	}
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], n)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// sealWriter encrypts in chunks, Close writes the last chunk
+type sealWriter struct {
+	W    io.Writer
+	AEAD cipher.AEAD
+	n    uint64
+	buf  []byte
+	out  []byte
+}
+
+func (w *sealWriter) Write(d []byte) (int, error) {
+	var o int
+	for len(d) > 0 {
+		// a full chunk is only sealed once more data follows, the last
+		// chunk has to be sealed as such
+		if len(w.buf) == cryptChunk {
+			err := w.seal(false)
+			if err != nil {
+				return o, err
+			}
+		}
+		n := cryptChunk - len(w.buf)
+		if n > len(d) {
+			n = len(d)
+		}
+		w.buf = append(w.buf, d[:n]...)
+		d = d[n:]
+		o += n
+	}
+	return o, nil
+}
+
+func (w *sealWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *sealWriter) seal(last bool) error {
+	nonce := chunkNonce(make([]byte, w.AEAD.NonceSize()), w.n, last)
+	w.out = w.AEAD.Seal(w.out[:0], nonce, w.buf, nil)
+	w.buf = w.buf[:0]
+	w.n++
+	_, err := w.W.Write(w.out)
+	return err
+}
+
+// openReader decrypts what sealWriter wrote
+type openReader struct {
+	R    *bufio.Reader
+	AEAD cipher.AEAD
+	n    uint64
+	in   []byte
+	buf  []byte
+	done bool
+}
+
+func (r *openReader) Read(d []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.in == nil {
+			r.in = make([]byte, cryptChunk+r.AEAD.Overhead())
+		}
+		n, err := io.ReadFull(r.R, r.in)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			r.done = true
+		} else if err != nil {
+			return 0, err
+		} else if _, err := r.R.Peek(1); err == io.EOF {
+			r.done = true
+		}
+		nonce := chunkNonce(make([]byte, r.AEAD.NonceSize()), r.n, r.done)
+		r.buf, err = r.AEAD.Open(r.in[:0], nonce, r.in[:n], nil)
+		if err != nil {
+			return 0, errCrypt
+		}
+		r.n++
+	}
+	n := copy(d, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
 type otherCloser struct {
 	io.Reader
 	Closer io.Closer
+	Inner  io.Closer // closed first, if set
 }
 
 func (oc otherCloser) Close() error {
+	if oc.Inner != nil {
+		oc.Inner.Close()
+	}
 	return oc.Closer.Close()
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func testAEAD(t *testing.T) cipher.AEAD {
+	b, err := aes.NewCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func testSeal(t *testing.T, aead cipher.AEAD, d []byte) []byte {
+	var b bytes.Buffer
+	w := &sealWriter{W: &b, AEAD: aead}
+	// odd writes so chunks don't line up with them
+	for len(d) > 0 {
+		n := 1000
+		if n > len(d) {
+			n = len(d)
+		}
+		_, err := w.Write(d[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		d = d[n:]
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func testOpen(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	return ioutil.ReadAll(&openReader{R: bufio.NewReader(bytes.NewReader(sealed)), AEAD: aead})
+}
+
+func TestCryptChunks(t *testing.T) {
+	aead := testAEAD(t)
+	sealedChunk := cryptChunk + aead.Overhead()
+	for _, size := range []int{0, 1, cryptChunk, cryptChunk + 1} {
+		d := make([]byte, size)
+		for i := range d {
+			d[i] = byte(i * 7)
+		}
+		sealed := testSeal(t, aead, d)
+		chunks := (size + cryptChunk - 1) / cryptChunk
+		if chunks == 0 {
+			chunks = 1 // an empty object still has its last chunk
+		}
+		if len(sealed) != size+chunks*aead.Overhead() {
+			t.Fatal(size, ": sealed to ", len(sealed), " bytes")
+		}
+		got, err := testOpen(aead, sealed)
+		if err != nil || !bytes.Equal(got, d) {
+			t.Fatal(size, ": opened ", len(got), " bytes, ", err)
+		}
+	}
+
+	d := bytes.Repeat([]byte{3, 1, 4}, cryptChunk)
+	sealed := testSeal(t, aead, d)
+	if len(sealed) != 2*sealedChunk+cryptChunk+aead.Overhead() {
+		t.Fatal("sealed to ", len(sealed), " bytes")
+	}
+
+	// truncated at a chunk boundary, the new last chunk wasn't sealed as such
+	for _, n := range []int{0, sealedChunk, 2 * sealedChunk} {
+		_, err := testOpen(aead, sealed[:n])
+		if err != errCrypt {
+			t.Fatal("truncated at ", n, ": ", err)
+		}
+	}
+
+	// swapped chunks
+	swapped := append([]byte{}, sealed...)
+	copy(swapped, sealed[sealedChunk:2*sealedChunk])
+	copy(swapped[sealedChunk:], sealed[:sealedChunk])
+	_, err := testOpen(aead, swapped)
+	if err != errCrypt {
+		t.Fatal("swapped: ", err)
+	}
+
+	// a flipped bit
+	sealed[sealedChunk+10] ^= 1
+	_, err = testOpen(aead, sealed)
+	if err != errCrypt {
+		t.Fatal("flipped: ", err)
+	}
+}
+
+// wal, also partial, and bases each get their codec
+func TestCryptCodec(t *testing.T) {
+	fs, _ := testFileStore(t)
+	cs := &cryptStore{Store: fs, Keys: map[int][]byte{0: bytes.Repeat([]byte{1}, 32)}, WALCodec: codecNone, BaseCodec: codecZstd}
+	for _, c := range []struct {
+		name  string
+		codec byte
+	}{
+		{"000001000000.1.wal", codecNone},
+		{"000001000000.1.00001000.partial", codecNone},
+		{"000001000000.1.1.base.part0", codecZstd},
+	} {
+		d := strings.Repeat(c.name, 1000)
+		err := cs.Upload(c.name, strings.NewReader(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := fs.Download(c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, fields, err := peekCryptHeader(bufio.NewReader(r))
+		r.Close()
+		if err != nil || string(fields['c']) != string(c.codec) {
+			t.Fatal(c.name, ": codec ", string(fields['c']), err)
+		}
+		r, err = cs.Download(c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(got) != d {
+			t.Fatal(c.name, ": read ", len(got), " bytes, ", err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileStore keeps objects as plain files in a local directory, eg an NFS
+// mount: file:///var/lib/pgbackup/store
+type fileStore struct {
+	Dir string
+}
+
+func newFileStore(u *url.URL) (*fileStore, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, errors.New("file store must be local; use file:///path")
+	}
+	dir := filepath.Clean(u.Path)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &fileStore{Dir: dir}, nil
+}
+
+func (s fileStore) Upload(name string, body io.Reader) error {
+	// write to a temp file first and rename, so a crash never leaves a
+	// truncated object under its final name
+	fh, err := ioutil.TempFile(s.Dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	tmp := fh.Name()
+
+	_, err = io.Copy(fh, body)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if err1 := fh.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.Dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = syncDir(s.Dir)
+	log.Print("file: upload ", name)
+	return err
+}
+
+func (s fileStore) Download(name string) (io.ReadCloser, error) {
+	fh, err := os.Open(filepath.Join(s.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+	log.Print("file: download ", name)
+	return fh, nil
+}
+
+func (s fileStore) List(prefix string, fn func(*StoreFile) error) error {
+	log.Print("list dir=", s.Dir, " prefix=", prefix)
+	names, err := readDirNames(s.Dir)
+	if err != nil {
+		return err
+	}
+
+	i := sort.SearchStrings(names, prefix)
+	for _, name := range names[i:] {
+		if !strings.HasPrefix(name, prefix) {
+			break
+		}
+		fi, err := os.Lstat(filepath.Join(s.Dir, name))
+		if os.IsNotExist(err) {
+			continue // removed while listing
+		} else if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		err = fn(&StoreFile{Name: name, Size: int(fi.Size())})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s fileStore) Delete(name string) error {
+	err := os.Remove(filepath.Join(s.Dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Print("file: delete ", name)
+	return nil
+}
+
+// readDirNames returns the sorted names in dir, without dotfiles
+func readDirNames(dir string) ([]string, error) {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	names, err := fh.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	for _, name := range names {
+		if !strings.HasPrefix(name, ".") {
+			names[n] = name
+			n++
+		}
+	}
+	names = names[:n]
+	sort.Strings(names)
+	return names, nil
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	return fh.Sync()
+}
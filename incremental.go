@@ -0,0 +1,267 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// baseManifest is the content of the name.base marker. Full bases of just
+// the data directory have an empty marker, incremental ones name the base
+// they build on. Bases of before manifests keep the last chunk of their
+// tar stream in the marker, they are full bases.
+type baseManifest struct {
+	Parent      string           `json:"parent,omitempty"`
+	Incremental bool             `json:"incremental,omitempty"`
+	Chain       int              `json:"chain,omitempty"` // incrementals since the full base
+	Tablespaces []baseTablespace `json:"tablespaces,omitempty"`
+
+	tail bool // the marker is the last part
+}
+
+// incrementalBaseName names an incremental base after its start and the
+// start lsn of its parent, so the chain is known from a listing without
+// reading markers: LSN.TIMELINE.TIME.PARENTLSN.base
+func incrementalBaseName(lsn uint64, timeline int, ts int64, parent uint64) string {
+	return fmt.Sprintf("%012x.%x.%x.%012x.base", lsn, timeline, ts, parent)
+}
+
+// baseParentLSN returns the parent lsn in the name of an incremental base,
+// 0 for a full base
+func baseParentLSN(name string) uint64 {
+	p := strings.Split(strings.TrimSuffix(name, ".base"), ".")
+	if len(p) != 4 {
+		return 0
+	}
+	lsn, err := strconv.ParseUint(p[3], 16, 64)
+	if err != nil {
+		return 0
+	}
+	return lsn
+}
+
+// baseTablespace is stored as name.tblspc.OID
+type baseTablespace struct {
+	OID      uint32 `json:"oid"`
+	Location string `json:"location"`
+}
+
+// maxManifest bounds what is read of a marker, a longer one is the tar
+// chunk of a legacy base
+const maxManifest = 1 << 20
+
+func (a *Agent) readManifest(name string) (*baseManifest, error) {
+	r, err := a.store.Download(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxManifest+1))
+	if err != nil {
+		return nil, err
+	}
+	m := &baseManifest{}
+	if len(b) > maxManifest || len(b) > 0 && !json.Valid(b) {
+		m.tail = true
+	} else if len(b) > 0 {
+		err = json.Unmarshal(b, m)
+		if err != nil {
+			return nil, fmt.Errorf("base %s: %s", name, err)
+		}
+	}
+	return m, nil
+}
+
+// baseChain returns the bases to restore for name, the full base first
+func (a *Agent) baseChain(name string) ([]string, error) {
+	chain := []string{name}
+	for {
+		m, err := a.readManifest(chain[0])
+		if err != nil {
+			return nil, err
+		}
+		if m.Parent == "" {
+			return chain, nil
+		}
+		if len(chain) > 1000 {
+			return nil, fmt.Errorf("base %s: chain too long", name)
+		}
+		chain = append([]string{m.Parent}, chain...)
+	}
+}
+
+// In an incremental base, relation files of the main fork hold only the
+// blocks changed since the parent base:
+//
+//	"PGBKINCR" | file size uint64 | n uint32 | n block numbers uint32 | n blocks
+//
+// Their tar entries are marked with a PAX record. Other files are stored
+// whole.
+const (
+	incrMagic      = "PGBKINCR"
+	incrHeader     = 20
+	paxIncremental = "PGBACKUP.incremental"
+)
+
+// filterIncremental copies the tar stream r of tablespace tblspc, 0 for
+// the data directory, to w, reducing relation files to the blocks changed
+// in g
+func filterIncremental(r io.Reader, w io.Writer, g *blockGen, tblspc uint32) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	block := make([]byte, blockSize)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		k, seg, ok := relFile(h.Name, tblspc)
+		if !ok || h.Typeflag != tar.TypeReg || g.Whole(k) || h.Size%blockSize != 0 {
+			err = tw.WriteHeader(h)
+			if err == nil {
+				_, err = io.Copy(tw, tr)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		first := seg * relSegBlocks
+		n := uint32(h.Size / blockSize)
+		var changed []uint32
+		for i := uint32(0); i < n; i++ {
+			if g.Changed(k, first+i) {
+				changed = append(changed, i)
+			}
+		}
+
+		hdr := make([]byte, incrHeader+4*len(changed))
+		copy(hdr, incrMagic)
+		binary.BigEndian.PutUint64(hdr[8:], uint64(h.Size))
+		binary.BigEndian.PutUint32(hdr[16:], uint32(len(changed)))
+		for i, b := range changed {
+			binary.BigEndian.PutUint32(hdr[incrHeader+4*i:], b)
+		}
+
+		size := h.Size
+		h.Size = int64(len(hdr) + blockSize*len(changed))
+		h.PAXRecords = map[string]string{paxIncremental: "1"}
+		h.Format = tar.FormatPAX
+		err = tw.WriteHeader(h)
+		if err == nil {
+			_, err = tw.Write(hdr)
+		}
+		for i := uint32(0); err == nil && int64(i)*blockSize < size; i++ {
+			_, err = io.ReadFull(tr, block)
+			if err == nil && len(changed) > 0 && changed[0] == i {
+				changed = changed[1:]
+				_, err = tw.Write(block)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return err
+	}
+	// the rest of the stream, so the backup completes
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// relFile parses the main fork relation file names of a tablespace tar,
+// base/DB/REL[.SEG] and global/REL[.SEG] in the data directory or
+// PG_VERSION_CATVERSION/DB/REL[.SEG] in others
+func relFile(name string, tblspc uint32) (relKey, uint32, bool) {
+	var k relKey
+	var file string
+	p := strings.Split(name, "/")
+	if tblspc != 0 {
+		if len(p) != 3 || !strings.HasPrefix(p[0], "PG_") {
+			return k, 0, false
+		}
+		db, err := strconv.ParseUint(p[1], 10, 32)
+		if err != nil {
+			return k, 0, false
+		}
+		k.Tblspc, k.DB, file = tblspc, uint32(db), p[2]
+	} else if len(p) == 3 && p[0] == "base" {
+		db, err := strconv.ParseUint(p[1], 10, 32)
+		if err != nil {
+			return k, 0, false
+		}
+		k.Tblspc, k.DB, file = 1663, uint32(db), p[2] // pg_default
+	} else if len(p) == 2 && p[0] == "global" {
+		k.Tblspc, file = 1664, p[1] // pg_global
+	} else {
+		return k, 0, false
+	}
+
+	seg := "0"
+	if i := strings.IndexByte(file, '.'); i >= 0 {
+		file, seg = file[:i], file[i+1:]
+	}
+	rel, err := strconv.ParseUint(file, 10, 32)
+	if err != nil {
+		return k, 0, false // other forks, pg_filenode.map, ...
+	}
+	n, err := strconv.ParseUint(seg, 10, 32)
+	if err != nil {
+		return k, 0, false
+	}
+	k.Rel = uint32(rel)
+	return k, uint32(n), true
+}
+
+// applyIncremental writes the changed blocks of an incremental file entry
+// over the file restored from the parent bases
+func applyIncremental(f *os.File, r io.Reader) error {
+	hdr := make([]byte, incrHeader)
+	_, err := io.ReadFull(r, hdr)
+	if err != nil {
+		return err
+	}
+	if string(hdr[:8]) != incrMagic {
+		return errors.New("not an incremental file")
+	}
+	size := int64(binary.BigEndian.Uint64(hdr[8:]))
+	n := binary.BigEndian.Uint32(hdr[16:])
+	if int64(n) > size/blockSize {
+		return errors.New("bad incremental file")
+	}
+
+	nums := make([]byte, 4*n)
+	_, err = io.ReadFull(r, nums)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if err != nil {
+		return err
+	}
+	block := make([]byte, blockSize)
+	for i := uint32(0); i < n; i++ {
+		_, err = io.ReadFull(r, block)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(block, int64(binary.BigEndian.Uint32(nums[4*i:]))*blockSize)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
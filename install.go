@@ -6,6 +6,8 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"os/user"
+	"strconv"
 )
 
 func (a *Agent) Install() {
@@ -34,11 +36,24 @@ func (a *Agent) Install() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		os.Chown("/etc/pgbackup.conf", 0, 0)
-		os.Chmod("/etc/pgbackup.conf", 0644)
+		// readable by the agent only, it holds credentials and keys
+		gid := 0
+		if g, err := user.LookupGroup("postgres"); err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		os.Chown("/etc/pgbackup.conf", 0, gid)
+		os.Chmod("/etc/pgbackup.conf", 0640)
 		log.Print("Copied pgbackup.conf to /etc/pgbackup.conf")
 	}
 
+	// spool for objects waiting to be uploaded, see spoolDir
+	os.MkdirAll("/var/lib/pgbackup", 0700)
+	if u, err := user.Lookup("postgres"); err == nil {
+		uid, _ := strconv.Atoi(u.Uid)
+		gid, _ := strconv.Atoi(u.Gid)
+		os.Chown("/var/lib/pgbackup", uid, gid)
+	}
+
 	err = ioutil.WriteFile("/etc/systemd/system/pgbackup.service", []byte(`[Unit]
 Description=pgbackup
 
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"./pgwal"
+)
+
+// walJournal is an fsynced copy of the wal segment being received, so in
+// synchronous mode wal can be reported flushed before it is uploaded. It
+// holds the segment lsn and timeline, followed by the wal received so far.
+type walJournal struct {
+	f   *os.File
+	end uint64 // atomic, lsn up to which the journal is synced
+}
+
+const journalHeader = 12
+
+func (a *Agent) journalPath() string {
+	return filepath.Join(a.spoolDir(), ".journal")
+}
+
+func openJournal(path string) (*walJournal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &walJournal{f: f}, nil
+}
+
+// Reset starts the journal over with the segment at lsn, data is what was
+// received of it already
+func (j *walJournal) Reset(lsn uint64, timeline int, data []byte) error {
+	h := make([]byte, journalHeader)
+	binary.BigEndian.PutUint64(h, lsn)
+	binary.BigEndian.PutUint32(h[8:], uint32(timeline))
+
+	err := j.f.Truncate(0)
+	if err == nil {
+		_, err = j.f.WriteAt(append(h, data...), 0)
+	}
+	if err == nil {
+		_, err = j.f.Seek(int64(journalHeader+len(data)), io.SeekStart)
+	}
+	if err == nil {
+		err = j.f.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint64(&j.end, lsn+uint64(len(data)))
+	return nil
+}
+
+// Append adds received wal, it is synced when Append returns
+func (j *walJournal) Append(d []byte) error {
+	_, err := j.f.Write(d)
+	if err == nil {
+		err = j.f.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&j.end, uint64(len(d)))
+	return nil
+}
+
+// Flushed returns the lsn up to which wal is stored, spooled or journaled
+func (j *walJournal) Flushed() uint64 {
+	return atomic.LoadUint64(&j.end)
+}
+
+func (j *walJournal) Close() {
+	j.f.Close()
+}
+
+// spoolJournal spools what a previous run, or the stream before a restart,
+// left in the journal as a partial segment, lsn.timeline.length.partial.
+// The primary may be gone by now and this is the only copy of the wal it
+// reported as flushed. The journal is emptied, not removed, it may be open.
+func (a *Agent) spoolJournal() error {
+	b, err := ioutil.ReadFile(a.journalPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if len(b) > journalHeader {
+		lsn := binary.BigEndian.Uint64(b)
+		timeline := int(binary.BigEndian.Uint32(b[8:]))
+		data := b[journalHeader:]
+		name := fmt.Sprintf("%012x.%x.%08x.partial", lsn, timeline, len(data))
+		err = a.spool.Put(name, bytes.NewReader(data), a.exitC)
+		if err != nil {
+			return err
+		}
+		log.Print("sync: spooled journal of ", len(data), " bytes @", pgwal.LSN(lsn))
+	}
+	return os.Truncate(a.journalPath(), 0)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Keys in pgbackup.conf are wrapped with a key encryption key (kek) from
+// the key-provider, so the config alone doesn't decrypt backups:
+//
+//	inline        keys are stored unwrapped (the default)
+//	file:PATH     kek in a file only readable by its owner
+//	env:NAME      kek in an environment variable
+//	exec:COMMAND  kek printed by a command, eg a vault helper
+//
+// The kek is 32 bytes, base64 encoded. Wrapped keys are stored as
+// "wrapped:" and the base64 of nonce and AES-GCM sealed key.
+//
+// inline is the one exception to keys being wrapped, for configs of before
+// key providers and setups without -key-provider. The config then is as
+// secret as the keys, wrap-keys moves them to a provider. With any other
+// provider unwrapped keys are refused.
+const wrappedPrefix = "wrapped:"
+
+func (a *Agent) loadKEK() ([]byte, error) {
+	if a.kek != nil {
+		return a.kek, nil
+	}
+
+	p := a.KeyProvider
+	var b []byte
+	var err error
+	switch {
+	case p == "" || p == "inline":
+		return nil, nil
+	case strings.HasPrefix(p, "file:"):
+		fn := p[len("file:"):]
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return nil, err
+		}
+		if fi.Mode().Perm()&077 != 0 {
+			return nil, fmt.Errorf("key-provider: %s must not be accessible by group or others (mode %s)", fn, fi.Mode().Perm())
+		}
+		b, err = ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+	case strings.HasPrefix(p, "env:"):
+		b = []byte(os.Getenv(p[len("env:"):]))
+		if len(b) == 0 {
+			return nil, fmt.Errorf("key-provider: %s is not set", p[len("env:"):])
+		}
+	case strings.HasPrefix(p, "exec:"):
+		cmd := exec.Command("/bin/sh", "-c", p[len("exec:"):])
+		cmd.Stderr = os.Stderr
+		b, err = cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("key-provider: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("key-provider: unknown provider %q", p)
+	}
+
+	kek, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil || len(kek) != 32 {
+		return nil, errors.New("key-provider: key must be 32 bytes, base64 encoded")
+	}
+	a.kek = kek
+	return kek, nil
+}
+
+// decodeKey returns the key stored in the config, label binds a wrapped
+// key to its place in the config
+func (a *Agent) decodeKey(label, s string) ([]byte, error) {
+	if !strings.HasPrefix(s, wrappedPrefix) {
+		if p := a.KeyProvider; p != "" && p != "inline" {
+			return nil, fmt.Errorf("key is not wrapped, key-provider %s needs wrapped keys", p)
+		}
+		return base64.StdEncoding.DecodeString(s)
+	}
+
+	kek, err := a.loadKEK()
+	if err != nil {
+		return nil, err
+	}
+	if kek == nil {
+		return nil, errors.New("key is wrapped but there is no key-provider")
+	}
+	b, err := base64.StdEncoding.DecodeString(s[len(wrappedPrefix):])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := kekAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+	key, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(label))
+	if err != nil {
+		return nil, errors.New("wrapped key does not match the key-provider")
+	}
+	return key, nil
+}
+
+// encodeKey returns key as stored in the config, wrapped if there is a
+// key-provider
+func (a *Agent) encodeKey(label string, key []byte) (string, error) {
+	kek, err := a.loadKEK()
+	if err != nil {
+		return "", err
+	}
+	if kek == nil {
+		return base64.StdEncoding.EncodeToString(key), nil
+	}
+
+	aead, err := kekAEAD(kek)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	b := aead.Seal(nonce, nonce, key, []byte(label))
+	return wrappedPrefix + base64.StdEncoding.EncodeToString(b), nil
+}
+
+func kekAEAD(kek []byte) (cipher.AEAD, error) {
+	b, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(b)
+}
+
+func keyLabel(id int) string {
+	return fmt.Sprintf("encrypt-key %d", id)
+}
+
+const privateKeyLabel = "encrypt-private-key"
+
+type WrapOpts struct {
+	KeyProvider string
+}
+
+// WrapKeys moves the keys in pgbackup.conf to another key-provider. A
+// file provider that doesn't exist yet is created with a new kek.
+func (a *Agent) WrapKeys(opts *WrapOpts) {
+	keys, err := a.keyring()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var private []byte
+	if a.EncryptPrivateKey != "" {
+		private, err = a.decodeKey(privateKeyLabel, a.EncryptPrivateKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = createKEKFile(opts.KeyProvider)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	a.KeyProvider = opts.KeyProvider
+	a.kek = nil
+	a.EncryptKey = ""
+	enc := map[int]string{}
+	for id, key := range keys {
+		enc[id], err = a.encodeKey(keyLabel(id), key)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(a.EncryptKeys) == 0 {
+		a.EncryptKey = enc[0]
+	} else {
+		a.EncryptKeys = enc
+	}
+	if private != nil {
+		a.EncryptPrivateKey, err = a.encodeKey(privateKeyLabel, private)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = a.writeConfig(a.configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Print("wrap-keys: ", len(keys), " keys in ", a.configFile, " now use key-provider ", a.KeyProvider)
+}
+
+// createKEKFile creates the kek of a file provider with a new key if it
+// doesn't exist yet
+func createKEKFile(provider string) error {
+	fn := strings.TrimPrefix(provider, "file:")
+	if fn == provider {
+		return nil
+	}
+	if _, err := os.Stat(fn); !os.IsNotExist(err) {
+		return nil
+	}
+	var kek [32]byte
+	_, err := rand.Read(kek[:])
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(fn, []byte(base64.StdEncoding.EncodeToString(kek[:])+"\n"), 0600)
+	if err != nil {
+		return err
+	}
+	log.Print("key-provider: created ", fn, ", it is needed to recover, keep a copy in a safe place")
+	return nil
+}
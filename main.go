@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"crypto/aes"
+	"crypto/ecdh"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -12,8 +13,12 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"syscall"
 )
 
 var (
@@ -21,21 +26,86 @@ var (
 	Host    = "pgbackup.com"
 )
 
+// slot names go into replication commands unquoted
+var slotName = regexp.MustCompile(`^[a-z0-9_]{1,63}$`)
+
 type Agent struct {
-	EncryptKey   string `json:"encrypt-key"`
-	ConnString   string `json:"conn-string"`
-	Auth         string `json:"auth"`
-	BackupID     int    `json:"id"`
-	GUID         string `json:"guid"`
-	Store        string `json:"store"`
-	Email        string `json:"email"`
-	WarnAt       string `json:"warn-at"`
-	Retention    int    `json:"retention"`
-	BaseInterval int    `json:"base-interval"`
-	Rollover     int    `json:"rollover"`
-
-	store Store
-	pgb   *http.Client
+	EncryptKey    string `json:"encrypt-key"`
+	ConnString    string `json:"conn-string"`
+	Auth          string `json:"auth"`
+	BackupID      int    `json:"id"`
+	GUID          string `json:"guid"`
+	Store         string `json:"store"`
+	Email         string `json:"email"`
+	WarnAt        string `json:"warn-at"`
+	Retention     int    `json:"retention"`
+	BaseInterval  int    `json:"base-interval"`
+	Rollover      int    `json:"rollover"`
+	SpoolDir      string `json:"spool-dir"`
+	SpoolSize     int    `json:"spool-size"` // MB
+	UploadWorkers int    `json:"upload-workers"`
+
+	EncryptKeys  map[int]string `json:"encrypt-keys,omitempty"` // by key id, 0 is encrypt-key
+	EncryptKeyID int            `json:"encrypt-key-id"`         // for new objects
+
+	// encrypt new objects to a X25519 public key, see keygen
+	EncryptPublicKey  string `json:"encrypt-public-key,omitempty"`
+	EncryptPrivateKey string `json:"encrypt-private-key,omitempty"`
+
+	KeyProvider string `json:"key-provider,omitempty"` // see keys.go
+
+	WALCodec  string `json:"wal-codec,omitempty"` // gzip, zstd, lz4 or none
+	BaseCodec string `json:"base-codec,omitempty"`
+
+	Slot       string `json:"slot,omitempty"`         // physical replication slot
+	SlotMaxWAL int    `json:"slot-max-wal,omitempty"` // MB not stored before the slot is dropped
+
+	Synchronous bool `json:"synchronous,omitempty"` // report wal flushed once journaled locally
+
+	// base schedule, see baseDue
+	BaseCron    string `json:"base-cron,omitempty"`     // crontab, replaces base-interval
+	BaseWindow  string `json:"base-window,omitempty"`   // eg "01:00-05:00"
+	BaseWALSize int    `json:"base-wal-size,omitempty"` // MB
+
+	BaseIncremental int `json:"base-incremental,omitempty"` // incremental bases between full ones
+
+	// BASE_BACKUP options
+	BaseLabel         string `json:"base-label,omitempty"`           // default pgbackup
+	BaseMaxRate       int    `json:"base-max-rate,omitempty"`        // kB/s
+	BaseMaxRateWindow string `json:"base-max-rate-window,omitempty"` // limit only within, eg "09:00-18:00"
+	BaseFast          bool   `json:"base-fast,omitempty"`            // immediate checkpoint
+	BaseTablespaceMap bool   `json:"base-tablespace-map,omitempty"`
+	BaseProgress      bool   `json:"base-progress,omitempty"` // size estimates for progress
+
+	// several clusters in one config, each overrides the settings above
+	// and has its own id, guid and encrypt keys. By default they get a
+	// store prefix and spool dir of their name.
+	Clusters    []json.RawMessage `json:"clusters,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	StorePrefix string            `json:"store-prefix,omitempty"`
+	UploadRate  int               `json:"upload-rate,omitempty"` // KB/s sent to the store, shared by all clusters
+
+	MetricsListen string `json:"metrics-listen,omitempty"` // prometheus endpoint, eg 127.0.0.1:9187
+	AdminListen   string `json:"admin-listen,omitempty"`   // unix:/path or localhost port, see serveAdmin
+
+	store     Store
+	spool     *spool
+	walStored *walTracker
+	blocks    *blockTracker
+	kek       []byte
+	pgb       *http.Client
+
+	clusters   []*Agent
+	inCluster  bool
+	uploadSem  chan bool // shared by all clusters
+	uploadRate *rateLimiter
+	stopC      chan bool
+	metrics    *agentMetrics
+	cmdC       chan *pumpCmd // from the admin api
+
+	baseCron       *cronSchedule
+	baseWindow     []timeWindow
+	baseRateWindow []timeWindow
 
 	exitC      chan bool
 	txLogC     chan []byte
@@ -56,24 +126,53 @@ func main() {
 	}
 
 	if cmd == "setup" {
-		a.Setup()
+		opts := &SetupOpts{}
+		f := flag.NewFlagSet("setup", flag.ExitOnError)
+		f.StringVar(&opts.KeyProvider, "key-provider", "", "Where the key wrapping the encryption key comes from; inline, file:PATH, env:NAME or exec:COMMAND")
+		f.Parse(os.Args[2:])
+		a.Setup(opts)
 
 	} else if cmd == "install" {
 		a.Install()
 
 	} else if cmd == "agent" {
 		a.ReadConfig()
-		a.Agent()
+		var err error
+		agents := a.clusters
+		if len(agents) == 0 {
+			agents = []*Agent{&a}
+		}
+		if a.MetricsListen != "" {
+			err = serveMetrics(a.MetricsListen, agents)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if a.AdminListen != "" {
+			err = serveAdmin(a.AdminListen, agents)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if len(a.clusters) > 0 {
+			err = a.AgentClusters()
+		} else {
+			err = a.Agent()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 
 	} else if cmd == "status" {
 		a.ReadConfig()
 		a.Status()
 
 	} else if cmd == "recover" {
-		opts := &RecoverOpts{}
+		opts := &RecoverOpts{TablespaceMapping: tablespaceMapping{}}
 		f := flag.NewFlagSet("recover", flag.ExitOnError)
 		f.StringVar(&opts.Target, "target", "latest", "Target to restore; 'latest' or [lsn]:[txid] or [lsn]:[txid]:[timeline]")
 		f.StringVar(&opts.Dir, "dir", "", "Directory where to load recovered cluster")
+		f.Var(opts.TablespaceMapping, "tablespace-mapping", "Restore the tablespace in directory old to new instead, old=new; can be repeated")
 		f.Parse(os.Args[2:])
 		if opts.Dir == "" {
 			f.PrintDefaults()
@@ -97,23 +196,63 @@ func main() {
 		a.ReadConfig()
 		a.Query(opts)
 
+	} else if cmd == "rekey" {
+		opts := &RekeyOpts{}
+		f := flag.NewFlagSet("rekey", flag.ExitOnError)
+		f.BoolVar(&opts.NewKey, "new-key", false, "Add a new encryption key to pgbackup.conf and make it the active key")
+		f.Parse(os.Args[2:])
+		a.ReadConfig()
+		a.Rekey(opts)
+
+	} else if cmd == "keygen" {
+		a.Keygen()
+
+	} else if cmd == "wrap-keys" {
+		opts := &WrapOpts{}
+		f := flag.NewFlagSet("wrap-keys", flag.ExitOnError)
+		f.StringVar(&opts.KeyProvider, "key-provider", "", "Where the key wrapping the keys in pgbackup.conf comes from; inline, file:PATH, env:NAME or exec:COMMAND")
+		f.Parse(os.Args[2:])
+		if opts.KeyProvider == "" {
+			f.PrintDefaults()
+			os.Exit(2)
+		}
+		a.ReadConfig()
+		a.WrapKeys(opts)
+
 	} else if cmd == "restore_command" {
-		a.readConfig(os.Args[2])
-		a.RestoreCommand(os.Args[3], os.Args[4])
+		err := a.readConfig(os.Args[2])
+		if err == nil && len(a.clusters) > 0 {
+			err = errors.New("select the cluster with PGBACKUP_CLUSTER")
+		}
+		if err == nil {
+			err = a.RestoreCommand(os.Args[3], os.Args[4])
+		}
+		if err != nil {
+			// postgres takes a failure as the file not being available
+			log.Fatal("restore_command: ", os.Args[3], ": ", err)
+		}
 
 	} else {
-		log.Fatal("usage: pgbackup [setup|install|agent|status|recover|query|dumptable]")
+		log.Fatal("usage: pgbackup [setup|install|agent|status|recover|query|rekey|keygen|wrap-keys|dumptable]")
 	}
 }
 
 func (a *Agent) ReadConfig() {
-	err := a.readConfig("pgbackup.conf")
-	if err != nil {
-		err = a.readConfig("/etc/pgbackup.conf")
-		if err != nil {
+	// only a missing config falls back, errors in it are reported
+	file := "pgbackup.conf"
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		file = "/etc/pgbackup.conf"
+		if _, err := os.Stat(file); os.IsNotExist(err) {
 			log.Fatal("Could not read pgbackup.conf or /etc/pgbackup.conf. Use '", os.Args[0], " setup' to start a new backup.")
 		}
 	}
+	err := a.readConfig(file)
+	if err != nil {
+		log.Fatal(file, ": ", err)
+	}
+	if len(a.clusters) > 0 && os.Args[1] != "agent" {
+		log.Fatal(a.configFile, " has ", len(a.clusters), " clusters, select one with PGBACKUP_CLUSTER=name")
+	}
 }
 
 func (a *Agent) readConfig(file string) error {
@@ -122,34 +261,153 @@ func (a *Agent) readConfig(file string) error {
 	if err != nil {
 		return err
 	}
+	defer fh.Close()
 
 	a.configFile, _ = filepath.Abs(fh.Name())
 
-	json.NewDecoder(fh).Decode(a)
-	if a.EncryptKey == "" || a.ConnString == "" || a.Store == "" || a.GUID == "" {
-		return errors.New("could not parse pgbackup.conf")
+	data, err := ioutil.ReadAll(fh)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, a)
+	if err != nil {
+		return err
+	}
+	if len(a.Clusters) > 0 {
+		return a.readClusters(data)
 	}
+	return a.configure()
+}
 
-	store, err := NewStore(a.Store)
+// configure checks the config and sets up the store
+func (a *Agent) configure() error {
+	if (a.EncryptKey == "" && len(a.EncryptKeys) == 0 && a.EncryptPublicKey == "") || a.ConnString == "" || a.Store == "" || a.GUID == "" {
+		return errors.New("needs conn-string, store, guid and an encrypt key")
+	}
+	if a.Slot != "" && !slotName.MatchString(a.Slot) {
+		return fmt.Errorf("slot %q must be 1 to 63 lower case letters, digits or underscores", a.Slot)
+	}
+
+	err := a.parseSchedule()
 	if err != nil {
 		return err
 	}
+	a.metrics = newAgentMetrics()
+	a.cmdC = make(chan *pumpCmd)
 
-	key, err := base64.StdEncoding.DecodeString(a.EncryptKey)
+	storeURL := a.Store
+	if a.StorePrefix != "" {
+		u, err := url.Parse(a.Store)
+		if err != nil {
+			return err
+		}
+		u.Path = path.Join("/", u.Path, a.StorePrefix)
+		storeURL = u.String()
+	}
+	store, err := NewStore(storeURL)
 	if err != nil {
 		return err
 	}
 
-	aes, err := aes.NewCipher(key)
+	cs := &cryptStore{Store: store, KeyID: a.EncryptKeyID}
+	cs.Keys, err = a.keyring()
+	if err != nil {
+		return err
+	}
+	cs.WALCodec, err = parseCodec(a.WALCodec)
+	if err != nil {
+		return err
+	}
+	cs.BaseCodec, err = parseCodec(a.BaseCodec)
 	if err != nil {
 		return err
 	}
 
-	a.store = &cryptStore{Store: store, Aes: aes}
+	if a.EncryptPublicKey != "" {
+		key, err := base64.StdEncoding.DecodeString(a.EncryptPublicKey)
+		if err != nil {
+			return err
+		}
+		cs.Public, err = ecdh.X25519().NewPublicKey(key)
+		if err != nil {
+			return err
+		}
+	}
+	if a.EncryptPrivateKey != "" {
+		key, err := a.decodeKey(privateKeyLabel, a.EncryptPrivateKey)
+		if err != nil {
+			return err
+		}
+		cs.Private, err = ecdh.X25519().NewPrivateKey(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	a.store = cs
 
 	return nil
 }
 
+// keyring returns the encryption keys by id, encrypt-key has id 0
+func (a *Agent) keyring() (map[int][]byte, error) {
+	keys := map[int][]byte{}
+	enc := map[int]string{}
+	for id, k := range a.EncryptKeys {
+		enc[id] = k
+	}
+	if a.EncryptKey != "" {
+		enc[0] = a.EncryptKey
+	}
+	for id, k := range enc {
+		key, err := a.decodeKey(keyLabel(id), k)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt key %d: %s", id, err)
+		}
+		_, err = aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encrypt key %d: %s", id, err)
+		}
+		keys[id] = key
+	}
+	if _, ok := keys[a.EncryptKeyID]; !ok && a.EncryptPublicKey == "" {
+		return nil, fmt.Errorf("no encrypt key with id %d", a.EncryptKeyID)
+	}
+	return keys, nil
+}
+
+// writeConfig replaces the config file, keeping its permissions
+func (a *Agent) writeConfig(file string) error {
+	if a.inCluster {
+		// this would replace all clusters with this one
+		return fmt.Errorf("%s has several clusters, change the settings of %s by hand", file, a.Name)
+	}
+	mode := os.FileMode(0600)
+	uid, gid := -1, -1
+	if fi, err := os.Stat(file); err == nil {
+		mode = fi.Mode()
+		// eg root:postgres as set by install, the agent must still read it
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+	}
+
+	b, err := json.MarshalIndent(a, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	err = ioutil.WriteFile(tmp, append(b, '\n'), mode)
+	if err == nil {
+		err = os.Chown(tmp, uid, gid)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
 func (a *Agent) BackendCall(method, path string, data interface{}, result interface{}) error {
 
 	var body io.Reader
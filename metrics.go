@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// agentMetrics are the numbers of an agent for the prometheus endpoint,
+// metrics-listen. A nil *agentMetrics ignores updates.
+type agentMetrics struct {
+	mu        sync.Mutex
+	received  uint64               // wal lsn received up to
+	stored    uint64               // wal lsn stored up to
+	segmentAt map[uint64]time.Time // when segments not stored yet started arriving
+	uploads   map[string]*histogram
+	failures  map[string]uint64
+	baseLast  time.Time // completed
+	base      *baseInfo // running
+	restarts  uint64    // of the pipeline
+	streams   uint64    // replication stream (re)starts
+	streaming bool
+	paused    bool // by the admin api
+	spool     *spool
+	uploadC   chan *Upload
+	txLogC    chan []byte
+}
+
+func newAgentMetrics() *agentMetrics {
+	return &agentMetrics{
+		segmentAt: map[uint64]time.Time{},
+		uploads:   map[string]*histogram{},
+		failures:  map[string]uint64{},
+	}
+}
+
+// walReceived records wal received up to lsn
+func (m *agentMetrics) walReceived(lsn uint64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seg := (lsn - 1) &^ uint64(walSegmentSize-1)
+	if lsn > m.received {
+		if _, ok := m.segmentAt[seg]; !ok && seg >= m.stored {
+			m.segmentAt[seg] = time.Now()
+		}
+		m.received = lsn
+	}
+}
+
+// walReset records the stream starting over at lsn, stored before
+func (m *agentMetrics) walReset(lsn uint64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.received, m.stored = lsn, lsn
+	m.segmentAt = map[uint64]time.Time{}
+}
+
+// walStored records wal stored up to lsn
+func (m *agentMetrics) walStored(lsn uint64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stored = lsn
+	for seg := range m.segmentAt {
+		if seg < lsn {
+			delete(m.segmentAt, seg)
+		}
+	}
+}
+
+// upload records an upload attempt of object name
+func (m *agentMetrics) upload(name string, d time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	kind := "other"
+	for _, k := range []string{"wal", "partial", "base", "history"} {
+		if strings.HasSuffix(name, "."+k) || strings.Contains(name, "."+k+".") {
+			kind = k
+			break
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.failures[kind]++
+		return
+	}
+	h := m.uploads[kind]
+	if h == nil {
+		h = &histogram{buckets: uploadBuckets, counts: make([]uint64, len(uploadBuckets))}
+		m.uploads[kind] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// baseRunning records the base backup b as running, nil once it ended
+func (m *agentMetrics) baseRunning(b *baseInfo) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.base = b
+}
+
+// baseDone records when the newest complete base was taken
+func (m *agentMetrics) baseDone(t time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.baseLast = t
+}
+
+func (m *agentMetrics) restart() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.restarts++
+}
+
+func (m *agentMetrics) streamStart() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.streams++
+}
+
+// streamState records whether wal is streamed and whether that is paused
+func (m *agentMetrics) streamState(streaming, paused bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.streaming, m.paused = streaming, paused
+}
+
+// pipeline records the queues of a pipeline (re)start
+func (m *agentMetrics) pipeline(sp *spool, uploadC chan *Upload, txLogC chan []byte) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.spool, m.uploadC, m.txLogC = sp, uploadC, txLogC
+}
+
+var uploadBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	sum     float64
+	n       uint64
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.n++
+}
+
+// serveMetrics serves the metrics of agents on /metrics at addr
+func serveMetrics(addr string, agents []*Agent) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(writeMetrics(agents, time.Now()))
+	})
+	log.Print("metrics: listening on ", l.Addr())
+	go func() {
+		log.Print("metrics: ", http.Serve(l, mux))
+	}()
+	return nil
+}
+
+// metricsText collects samples by metric, for the text exposition format
+type metricsText struct {
+	names []string
+	head  map[string]string
+	lines map[string][]string
+}
+
+func (t *metricsText) add(name, typ, help, series string, v float64) {
+	if t.head == nil {
+		t.head = map[string]string{}
+		t.lines = map[string][]string{}
+	}
+	if _, ok := t.head[name]; !ok {
+		t.names = append(t.names, name)
+		t.head[name] = fmt.Sprintf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+	t.lines[name] = append(t.lines[name], fmt.Sprintf("%s %g\n", series, v))
+}
+
+func writeMetrics(agents []*Agent, now time.Time) []byte {
+	t := &metricsText{}
+	for _, a := range agents {
+		m := a.metrics
+		if m == nil {
+			continue
+		}
+		labels := func(extra ...string) string {
+			var l []string
+			if a.Name != "" {
+				l = append(l, fmt.Sprintf("cluster=%q", a.Name))
+			}
+			l = append(l, extra...)
+			if len(l) == 0 {
+				return ""
+			}
+			return "{" + strings.Join(l, ",") + "}"
+		}
+
+		m.mu.Lock()
+		t.add("pgbackup_wal_received_lsn", "gauge", "Wal lsn received from the server.", "pgbackup_wal_received_lsn"+labels(), float64(m.received))
+		t.add("pgbackup_wal_stored_lsn", "gauge", "Wal lsn up to which all segments are uploaded.", "pgbackup_wal_stored_lsn"+labels(), float64(m.stored))
+		var lagBytes, lagSeconds float64
+		if m.received > m.stored {
+			lagBytes = float64(m.received - m.stored)
+			if at, ok := m.segmentAt[m.stored&^uint64(walSegmentSize-1)]; ok {
+				lagSeconds = now.Sub(at).Seconds()
+			}
+		}
+		t.add("pgbackup_wal_upload_lag_bytes", "gauge", "Wal received but not uploaded yet.", "pgbackup_wal_upload_lag_bytes"+labels(), lagBytes)
+		t.add("pgbackup_wal_upload_lag_seconds", "gauge", "Age of the oldest wal not uploaded yet.", "pgbackup_wal_upload_lag_seconds"+labels(), lagSeconds)
+
+		var kinds []string
+		for k := range m.uploads {
+			kinds = append(kinds, k)
+		}
+		sort.Strings(kinds)
+		for _, k := range kinds {
+			h := m.uploads[k]
+			var n uint64
+			for i, b := range h.buckets {
+				n += h.counts[i]
+				t.add("pgbackup_upload_duration_seconds", "histogram", "Duration of successful uploads by object kind.", "pgbackup_upload_duration_seconds_bucket"+labels(fmt.Sprintf("kind=%q", k), fmt.Sprintf("le=\"%g\"", b)), float64(n))
+			}
+			t.add("pgbackup_upload_duration_seconds", "histogram", "", "pgbackup_upload_duration_seconds_bucket"+labels(fmt.Sprintf("kind=%q", k), `le="+Inf"`), float64(h.n))
+			t.add("pgbackup_upload_duration_seconds", "histogram", "", "pgbackup_upload_duration_seconds_sum"+labels(fmt.Sprintf("kind=%q", k)), h.sum)
+			t.add("pgbackup_upload_duration_seconds", "histogram", "", "pgbackup_upload_duration_seconds_count"+labels(fmt.Sprintf("kind=%q", k)), float64(h.n))
+		}
+		kinds = kinds[:0]
+		for k := range m.failures {
+			kinds = append(kinds, k)
+		}
+		sort.Strings(kinds)
+		for _, k := range kinds {
+			t.add("pgbackup_upload_failures_total", "counter", "Failed upload attempts by object kind.", "pgbackup_upload_failures_total"+labels(fmt.Sprintf("kind=%q", k)), float64(m.failures[k]))
+		}
+
+		var running, read, size float64
+		if m.base != nil {
+			running = 1
+			read = float64(atomic.LoadInt64(&m.base.read))
+			size = float64(m.base.Size)
+		}
+		t.add("pgbackup_base_running", "gauge", "Whether a base backup is running.", "pgbackup_base_running"+labels(), running)
+		t.add("pgbackup_base_read_bytes", "gauge", "Bytes of the running base backup read so far.", "pgbackup_base_read_bytes"+labels(), read)
+		t.add("pgbackup_base_estimated_bytes", "gauge", "Estimated size of the running base backup, 0 without base-progress.", "pgbackup_base_estimated_bytes"+labels(), size)
+		if !m.baseLast.IsZero() {
+			t.add("pgbackup_base_age_seconds", "gauge", "Age of the newest complete base backup.", "pgbackup_base_age_seconds"+labels(), now.Sub(m.baseLast).Seconds())
+		}
+
+		t.add("pgbackup_upload_queue_length", "gauge", "Objects queued for the uploader.", "pgbackup_upload_queue_length"+labels(), float64(len(m.uploadC)))
+		t.add("pgbackup_txlog_queue_length", "gauge", "Wal messages queued for the tx log.", "pgbackup_txlog_queue_length"+labels(), float64(len(m.txLogC)))
+		if m.spool != nil {
+			n, used := m.spool.Stats()
+			t.add("pgbackup_spool_objects", "gauge", "Objects spooled for upload.", "pgbackup_spool_objects"+labels(), float64(n))
+			t.add("pgbackup_spool_bytes", "gauge", "Size of the objects spooled for upload.", "pgbackup_spool_bytes"+labels(), float64(used))
+		}
+		t.add("pgbackup_restarts_total", "counter", "Restarts of the pipeline after a failure.", "pgbackup_restarts_total"+labels(), float64(m.restarts))
+		t.add("pgbackup_stream_starts_total", "counter", "Replication stream starts, including reconnects and timeline switches.", "pgbackup_stream_starts_total"+labels(), float64(m.streams))
+		m.mu.Unlock()
+	}
+
+	var b bytes.Buffer
+	for _, n := range t.names {
+		b.WriteString(t.head[n])
+		for _, l := range t.lines[n] {
+			b.WriteString(l)
+		}
+	}
+	return b.Bytes()
+}
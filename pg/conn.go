@@ -13,6 +13,8 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -23,6 +25,16 @@ var (
 type Conn struct {
 	conn net.Conn
 	rb   io.Reader
+	err  error // set before a stream channel is closed on failure
+
+	// set when replication ended at the end of a timeline, before the
+	// channel is closed
+	nextTimeline    int
+	nextTimelineLsn string
+
+	wmu      sync.Mutex // status updates are sent beside the replication stream
+	received uint64     // atomic, end of the wal received
+	flushed  func() uint64
 
 	ServerVersion string
 }
@@ -100,10 +112,19 @@ func NewConn(connString string) (*Conn, error) {
 	return c, nil
 }
 
+// Close terminates the session, a wal sender exits cleanly
 func (c *Conn) Close() {
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second)) // the server may be gone
+	c.send('X', WriteBuf{})
 	c.conn.Close()
 }
 
+// Err returns the error that ended a replication or base backup stream, or
+// nil if the stream ended normally. Only valid after the channel is closed.
+func (c *Conn) Err() error {
+	return c.err
+}
+
 func (c *Conn) SimpleQuery(q string) ([][]interface{}, error) {
 
 	b := WriteBuf{}
@@ -194,6 +215,8 @@ func (c *Conn) send(tag byte, payload WriteBuf) error {
 	d[0] = tag
 	binary.BigEndian.PutUint32(d[1:], uint32(len(payload)+4))
 	d = append(d, []byte(payload)...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
 	_, err := c.conn.Write(d)
 	return err
 }
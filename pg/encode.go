@@ -37,11 +37,11 @@ func (c *Conn) decodeText(raw []byte, colType uint32, colFormat uint16) interfac
 	switch colType {
 	case 18, 1043, 25: // T_char, T_varchar, T_text
 		return string(raw)
-	case 17: // T_bytea
-		return "todo"
+	case 17: // T_bytea, as sent (escaped in query results, raw from TIMELINE_HISTORY)
+		return raw
 	case 16: // T_bool
 		return raw[0] == 'T'
-	case 20, 23, 21: // T_int8, T_int4, T_int2
+	case 20, 23, 21, 26: // T_int8, T_int4, T_int2, T_oid
 		i, _ := strconv.ParseInt(string(raw), 10, 64)
 		return i
 	case 700: // T_float4
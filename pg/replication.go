@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,10 +35,79 @@ type WALData struct {
 	Data       []byte
 }
 
+// TimelineHistory returns the file name and content of the history file of
+// timeline
+func (c *Conn) TimelineHistory(timeline int) (string, []byte, error) {
+	rows, err := c.SimpleQuery(fmt.Sprintf("TIMELINE_HISTORY %d", timeline))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(rows) != 1 || len(rows[0]) != 2 {
+		return "", nil, errProtocol
+	}
+	name, _ := rows[0][0].(string)
+	switch content := rows[0][1].(type) {
+	case []byte:
+		return name, content, nil
+	case string:
+		return name, []byte(content), nil
+	}
+	return "", nil, errProtocol
+}
+
+// NextTimeline returns the timeline and its start lsn the server switched
+// to when replication ended at the end of a timeline, 0 if it didn't. Only
+// valid after the channel is closed.
+func (c *Conn) NextTimeline() (int, string) {
+	return c.nextTimeline, c.nextTimelineLsn
+}
+
+// CreateReplicationSlot creates a physical slot, it returns false if the
+// slot already exists
+func (c *Conn) CreateReplicationSlot(slot string) (bool, error) {
+	_, err := c.SimpleQuery(fmt.Sprintf("CREATE_REPLICATION_SLOT %s PHYSICAL", slot))
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		c.processReady()
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *Conn) DropReplicationSlot(slot string) error {
+	_, err := c.SimpleQuery(fmt.Sprintf("DROP_REPLICATION_SLOT %s", slot))
+	if err != nil {
+		// eg the slot is still active, the connection stays usable
+		c.processReady()
+	}
+	return err
+}
+
+// statusInterval is how often standby status is sent, as the default
+// wal_receiver_status_interval
+const statusInterval = 10 * time.Second
+
 // https://www.postgresql.org/docs/9.5/static/protocol-replication.html
-func (c *Conn) StartReplication(lsn string, timeline int) (<-chan WALData, error) {
+// The server keeps wal for slot (if set) until it is reported as flushed.
+// When timeline is not the current timeline of the server, replication
+// ends at its end, see NextTimeline.
+//
+// Standby status is sent every statusInterval and when the server asks for
+// it, with the received wal as written and the lsn returned by flushed as
+// flushed and applied. Closing stopC ends the goroutines of the stream once
+// the caller stops reading, the connection can't be used for anything else
+// then.
+func (c *Conn) StartReplication(slot, lsn string, timeline int, flushed func() uint64, stopC <-chan bool) (<-chan WALData, error) {
+	q := fmt.Sprintf("START_REPLICATION %s TIMELINE %d", lsn, timeline)
+	if slot != "" {
+		q = fmt.Sprintf("START_REPLICATION SLOT %s PHYSICAL %s TIMELINE %d", slot, lsn, timeline)
+	}
+	c.nextTimeline, c.nextTimelineLsn = 0, ""
+	c.flushed = flushed
+	var hi, lo uint32
+	fmt.Sscanf(lsn, "%X/%X", &hi, &lo)
+	atomic.StoreUint64(&c.received, uint64(hi)<<32|uint64(lo))
 	b := WriteBuf{}
-	b.String(fmt.Sprintf("START_REPLICATION %s", lsn))
+	b.String(q)
 	c.send('Q', b)
 
 	for {
@@ -52,19 +123,52 @@ func (c *Conn) StartReplication(lsn string, timeline int) (<-chan WALData, error
 	}
 
 	walC := make(chan WALData)
+	doneC := make(chan bool)
+	go func() {
+		t := time.NewTicker(statusInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-doneC:
+				return
+			case <-stopC:
+				return
+			case <-t.C:
+				c.StandbyStatus(false)
+			}
+		}
+	}()
 	go func() {
 		// todo: hmm, do we need to lock c.rb now?
 		defer close(walC)
-		var clientLsn uint64
+		defer close(doneC)
 		for {
 			tag, payload, err := c.recv()
 			if err != nil {
 				log.Print("pg: replication err=", err)
+				c.err = err
 				c.processReady()
 				return
 			}
 
 			switch tag {
+			case 'c': // CopyDone, the end of the timeline
+				c.send('c', WriteBuf{})
+				rows, err := c.processResult()
+				if err == nil && len(rows) == 1 && len(rows[0]) == 2 {
+					tli, _ := rows[0][0].(int64)
+					lsn, _ := rows[0][1].(string)
+					c.nextTimeline, c.nextTimelineLsn = int(tli), lsn
+					_, err = c.processResult() // START_STREAMING
+				}
+				if err == nil {
+					err = c.processReady()
+				}
+				if err != nil {
+					log.Print("pg: replication end err=", err)
+				}
+				c.err = err
+				return
 			case 'd':
 				b := ReadBuf(payload)
 				tag = b.Byte()
@@ -76,19 +180,22 @@ func (c *Conn) StartReplication(lsn string, timeline int) (<-chan WALData, error
 					p.ServerTime = time.Unix(0, b.Int64()*1000000)
 					p.Data = []byte(b)
 					//log.Print("walData! tag=", tag, " lsn=", p.Lsn, " serverLsn=", p.ServerLsn, " data=", len(p.Data))
-					walC <- p
+					// before handing it on, a status sent once p is journaled
+					// must not cap flush at the previous message
+					atomic.StoreUint64(&c.received, p.Lsn+uint64(len(p.Data)))
+					select {
+					case walC <- p:
+					case <-stopC:
+						return
+					}
 					// TODO: queue locally if sending would block, we'd need flow control on the channel
-					clientLsn = p.ServerLsn
 				case 'k':
-					log.Print("pg: ping received")
-					b := WriteBuf{}
-					b.Byte('r')
-					b.Int64(int64(clientLsn))
-					b.Int64(int64(clientLsn))
-					b.Int64(int64(clientLsn))
-					b.Int64(pgEpoch())
-					b.Byte(0)
-					c.send('d', b)
+					b.Int64() // server wal end
+					b.Int64() // server time
+					if b.Byte() == 1 {
+						// reply requested, eg to avoid wal_sender_timeout
+						c.StandbyStatus(false)
+					}
 				}
 			default:
 				log.Print("pg: StartReplication unknown tag=", string(tag))
@@ -98,65 +205,164 @@ func (c *Conn) StartReplication(lsn string, timeline int) (<-chan WALData, error
 	return walC, nil
 }
 
+// StandbyStatus sends the positions of a running replication to the server,
+// with reply the server answers with a keepalive. The flushed position is
+// never reported beyond the received one.
+func (c *Conn) StandbyStatus(reply bool) error {
+	write := atomic.LoadUint64(&c.received)
+	flush := write
+	if c.flushed != nil && c.flushed() < write {
+		flush = c.flushed()
+	}
+
+	b := WriteBuf{}
+	b.Byte('r')
+	b.Int64(int64(write))
+	b.Int64(int64(flush))
+	b.Int64(int64(flush)) // applied
+	b.Int64(pgEpoch())
+	if reply {
+		b.Byte(1)
+	} else {
+		b.Byte(0)
+	}
+	return c.send('d', b)
+}
+
 // pgEpoch returns microseconds since Jan 1, 2000
 func pgEpoch() int64 {
 	return time.Since(time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)).Nanoseconds() / 1000
 }
 
-func (c *Conn) BaseBackup(label string, maxRate int) (int, string, <-chan []byte, error) {
+// BaseBackupOpts are the options of BASE_BACKUP
+type BaseBackupOpts struct {
+	Label         string
+	MaxRate       int  // kB/s, 0 for no limit
+	Fast          bool // checkpoint immediately instead of spread out
+	TablespaceMap bool // tablespace_map file instead of pg_tblspc symlinks
+	Progress      bool // estimate sizes, the server scans the files first
+}
+
+// Tablespace is an archive of a base backup, OID 0 is the data directory
+type Tablespace struct {
+	OID      uint32
+	Location string
+	Size     int64 // estimate in kB with Progress, else -1
+}
+
+// BaseArchive is the tar stream of a tablespace, C is closed at its end
+type BaseArchive struct {
+	Tablespace
+	C <-chan []byte
+}
+
+// BaseBackup starts a base backup, the archives are sent on the returned
+// channel one after the other, each has to be read to its end before the
+// next is sent. Both channels are closed early on errors, see Err.
+func (c *Conn) BaseBackup(opts BaseBackupOpts) (int, string, []Tablespace, <-chan *BaseArchive, error) {
 	b := WriteBuf{}
-	q := fmt.Sprintf("BASE_BACKUP LABEL '%s' NOWAIT", label)
-	if maxRate > 0 {
-		q += fmt.Sprintf(" MAX_RATE %d", maxRate)
+	q := fmt.Sprintf("BASE_BACKUP LABEL '%s' NOWAIT", strings.Replace(opts.Label, "'", "''", -1))
+	if opts.MaxRate > 0 {
+		q += fmt.Sprintf(" MAX_RATE %d", opts.MaxRate)
+	}
+	if opts.Fast {
+		q += " FAST"
+	}
+	if opts.TablespaceMap {
+		q += " TABLESPACE_MAP"
+	}
+	if opts.Progress {
+		q += " PROGRESS"
 	}
 	b.String(q)
 	c.send('Q', b)
 
 	rows, err := c.processResult()
 	if err != nil {
-		return 0, "", nil, err
+		return 0, "", nil, nil, err
 	}
 	if len(rows) != 1 || len(rows[0]) != 2 {
-		return 0, "", nil, errProtocol
+		return 0, "", nil, nil, errProtocol
 	}
 	startLsn := rows[0][0].(string)
 	timeline := rows[0][1].(int64)
 
+	// spcoid, spclocation, size; the data directory last, without oid
 	rows, err = c.processResult()
 	if err != nil {
-		return 0, "", nil, err
+		return 0, "", nil, nil, err
+	}
+	var tablespaces []Tablespace
+	for _, row := range rows {
+		if len(row) != 3 {
+			return 0, "", nil, nil, errProtocol
+		}
+		ts := Tablespace{Size: -1}
+		oid, _ := row[0].(int64)
+		ts.OID = uint32(oid)
+		ts.Location, _ = row[1].(string)
+		if size, ok := row[2].(int64); ok {
+			ts.Size = size
+		}
+		tablespaces = append(tablespaces, ts)
 	}
-	//log.Print("tblMappingRow=", rows)
 
-	bbC := make(chan []byte)
+	// an archive per tablespace, in the order of the rows
+	archC := make(chan *BaseArchive)
 	go func() {
-		done := false
-		for !done {
+		var cur chan []byte
+		fail := func(err error) {
+			log.Print("pg: BaseBackup err=", err)
+			c.err = err
+			if cur != nil {
+				close(cur)
+			}
+			close(archC)
+		}
+		for i := 0; i < len(tablespaces); {
 			tag, payload, err := c.recv()
 			if err != nil {
-				log.Print("pg: BaseBackup err=", err)
-				close(bbC)
+				fail(err)
 				return
 			}
 
 			switch tag {
 			case 'H': // CopyOutResponse
+				cur = make(chan []byte)
+				archC <- &BaseArchive{Tablespace: tablespaces[i], C: cur}
 			case 'd': // CopyData
-				bbC <- payload
+				if cur == nil {
+					fail(errProtocol)
+					return
+				}
+				cur <- payload
 			case 'c': // CopyDone
-				done = true
+				if cur == nil {
+					fail(errProtocol)
+					return
+				}
+				close(cur)
+				cur = nil
+				i++
 			default:
 				log.Print("pg: BaseBackup unknown tag=", string(tag))
 			}
 		}
 
-		rows, _ := c.processResult()
+		rows, err := c.processResult()
+		if err == nil && len(rows) != 1 {
+			err = errProtocol
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
 		log.Print("pg: BaseBackup end=", rows[0])
 
 		c.processResult() // TODO: not sure why/if this is necessary
 
-		close(bbC)
+		close(archC)
 	}()
 
-	return int(timeline), startLsn, bbC, nil
+	return int(timeline), startLsn, tablespaces, archC, nil
 }
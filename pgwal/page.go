@@ -19,6 +19,9 @@ type Page struct {
 	Data       []byte
 }
 
+// Magic95 is the XLOG_PAGE_MAGIC of 9.5, the wal format parsed
+const Magic95 = 0xd087
+
 var ErrWeirdPage = errors.New("weirdPage")
 
 func ParsePage(d []byte) (*Page, error) {
@@ -42,7 +45,7 @@ func ParsePage(d []byte) (*Page, error) {
 	p.WordSize = 8 // hmm, how to determine automatically?
 
 	p.Magic = p.Uint16(d[0:2])
-	if p.Magic != 0xd087 {
+	if p.Magic != Magic95 {
 		log.Print(fmt.Sprintf("p.Magic=%x", p.Magic))
 		return nil, ErrWeirdPage
 	}
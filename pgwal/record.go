@@ -25,6 +25,12 @@ type RecordCont struct {
 	skip int // header bytes skipped while filling buf
 }
 
+// Copy makes cont independent of the copy it was assigned from, eg to look
+// ahead into a partial page
+func (cont *RecordCont) Copy() {
+	cont.buf = append([]byte(nil), cont.buf...)
+}
+
 func (p *Page) Records(cont *RecordCont) []*Record {
 
 	buf := cont.buf
@@ -96,6 +102,8 @@ func (r Record) IsInit() bool {
 const (
 	RmgrXlog  = 0x00
 	RmgrTx    = 0x01
+	RmgrSmgr  = 0x02
+	RmgrDbase = 0x04
 	RmgrHeap2 = 0x09
 	RmgrHeap  = 0x0A
 	RmgrBtree = 0x0B
@@ -135,9 +143,9 @@ var pgEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
 func (r Record) Rel() (tblspcID, dbID, relID uint32) {
 	// Different blocks in this record might be for different relations, but let's use
 	// this heuristic for now
-	r.eachBlock(func(a, b, c uint32, d []byte) {
-		if a != 0 {
-			tblspcID, dbID, relID = a, b, c
+	r.eachBlock(func(b BlockRef) {
+		if b.Tblspc != 0 {
+			tblspcID, dbID, relID = b.Tblspc, b.DB, b.Rel
 		}
 	})
 	return
@@ -145,8 +153,8 @@ func (r Record) Rel() (tblspcID, dbID, relID uint32) {
 
 func (r Record) CommitTime() time.Time {
 	if r.Type() == "commit" {
-		main := r.eachBlock(nil)
-		if len(main) > 8 {
+		main, _ := r.eachBlock(nil)
+		if len(main) >= 8 {
 			ts := r.Uint64(main[0:8])
 			return pgEpoch.Add(time.Duration(ts) * time.Microsecond)
 		}
@@ -154,35 +162,90 @@ func (r Record) CommitTime() time.Time {
 	return time.Time{}
 }
 
-func (r Record) eachBlock(cb func(uint32, uint32, uint32, []byte)) []byte {
+// BlockRef is a relation block a record changes
+type BlockRef struct {
+	Tblspc, DB, Rel uint32
+	Fork            byte // 0 main, 1 fsm, 2 vm, 3 init
+	Block           uint32
+}
 
-	data := r.Data
+// Blocks returns the blocks the record changes, ok is false if its headers
+// are malformed and some may be missing
+func (r Record) Blocks() (bb []BlockRef, ok bool) {
+	_, ok = r.eachBlock(func(b BlockRef) {
+		bb = append(bb, b)
+	})
+	return bb, ok
+}
 
-	var tblspcID, dbID, relID uint32
-	for {
-		if len(data) < 5 {
-			log.Print("shit weird block header=", len(data), " ", data)
-			return []byte{}
-		}
+// MainData returns the rmgr specific data of the record
+func (r Record) MainData() []byte {
+	main, _ := r.eachBlock(nil)
+	return main
+}
 
+// eachBlock calls cb for the block headers and returns the main data. The
+// headers come first, followed by the block images and data, followed by
+// the main data. ok is false for malformed headers.
+func (r Record) eachBlock(cb func(BlockRef)) (main []byte, ok bool) {
+
+	if r.Len < 24 || int(r.Len)-24 > len(r.Data) {
+		return []byte{}, false
+	}
+	data := r.Data[:r.Len-24]
+
+	var b BlockRef
+	var payload int // block images and data after the headers
+	// without main data, what is left after the headers is the payload, eg
+	// of XLOG_FPI
+	for len(data) > payload {
 		blockID := data[0]
-		// 0-32: indicates a XLogRecordBlockHeader
-		if blockID == 254 {
-			// 254: XLogRecordDataHeaderShort
-			data = data[5:]
-			break
-		} else if blockID == 255 {
-			// 255: XLogRecordDataHeaderLong
+		if blockID == 255 {
+			// XLR_BLOCK_ID_DATA_SHORT, XLogRecordDataHeaderShort
+			if len(data) < 2 {
+				break
+			}
+			n := int(data[1])
 			data = data[2:]
+			if payload+n > len(data) {
+				break
+			}
+			return data[payload : payload+n], true
+		} else if blockID == 254 {
+			// XLR_BLOCK_ID_DATA_LONG, XLogRecordDataHeaderLong
+			if len(data) < 5 {
+				break
+			}
+			n := int(r.Uint32(data[1:5]))
+			data = data[5:]
+			if payload+n > len(data) {
+				break
+			}
+			return data[payload : payload+n], true
+		} else if blockID == 253 {
+			// XLR_BLOCK_ID_ORIGIN, RepOriginId
+			if len(data) < 3 {
+				break
+			}
+			data = data[3:]
+			continue
+		} else if blockID == 252 {
+			// XLR_BLOCK_ID_TOPLEVEL_XID, TransactionId
+			if len(data) < 5 {
+				break
+			}
+			data = data[5:]
+			continue
+		} else if blockID > 32 {
 			break
 		}
-		if len(data) < 24 {
-			log.Print("shit weird block header=", len(data), " ", data)
-			return []byte{}
-		}
 
+		// 0-32: XLogRecordBlockHeader
+		if len(data) < 4 {
+			break
+		}
 		forkFlags := data[1]
-		//length := r.Uint16(data[2:4])
+		payload += int(r.Uint16(data[2:4]))
 		data = data[4:]
 
 		if (forkFlags & 0x10) == 0x10 {
@@ -191,28 +254,47 @@ func (r Record) eachBlock(cb func(uint32, uint32, uint32, []byte)) []byte {
 			// uint16 length
 			// uint16 hole_offset
 			// uint8 bimg_info
-			// length = r.Uint16(data[0:2])
+			if len(data) < 5 {
+				break
+			}
+			payload += int(r.Uint16(data[0:2]))
 			bimgInfo := data[4]
 			data = data[5:]
+			// the layout up to 14, from 15 on 0x02 is BKPIMAGE_APPLY.
+			// ParsePage only accepts 9.5 pages.
 			if (bimgInfo & 0x03) == 0x03 {
 				// BKPIMAGE_HAS_HOLE & BKPIMAGE_IS_COMPRESSED
 				// XLogRecordBlockCompressHeader
 				// uint16 hole_length
+				if len(data) < 2 {
+					break
+				}
 				data = data[2:]
 			}
 		}
 
 		if (forkFlags & 0x80) == 0 {
 			// not BKPBLOCK_SAME_REL
-			tblspcID, dbID, relID = r.Uint32(data[0:4]), r.Uint32(data[4:8]), r.Uint32(data[8:12])
+			if len(data) < 12 {
+				break
+			}
+			b.Tblspc, b.DB, b.Rel = r.Uint32(data[0:4]), r.Uint32(data[4:8]), r.Uint32(data[8:12])
 			data = data[12:]
 		}
 
-		//blockNumber := r.Uint32(data[0:4])
+		if len(data) < 4 {
+			break
+		}
+		b.Fork = forkFlags & 0x0f
+		b.Block = r.Uint32(data[0:4])
 		data = data[4:]
 		if cb != nil {
-			cb(tblspcID, dbID, relID, data)
+			cb(b)
 		}
 	}
-	return data
+	if len(data) != payload {
+		log.Print("weird block header @", r.LSN, " len=", r.Len)
+		return []byte{}, false
+	}
+	return []byte{}, true // no main data
 }
@@ -0,0 +1,107 @@
+package pgwal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func testRecord(rmgr, info byte, data []byte) Record {
+	return Record{
+		Endian: Endian{ByteOrder: binary.LittleEndian, WordSize: 8},
+		Len:    uint32(24 + len(data)),
+		Rmgr:   rmgr,
+		Info:   info,
+		Data:   data,
+	}
+}
+
+func TestRecordMainData(t *testing.T) {
+	le := binary.LittleEndian
+	at := time.Date(2016, 5, 4, 3, 2, 1, 0, time.UTC)
+	commit := make([]byte, 12)
+	le.PutUint64(commit, uint64(at.Sub(pgEpoch)/time.Microsecond))
+
+	// XLR_BLOCK_ID_DATA_SHORT
+	r := testRecord(RmgrTx, 0, append([]byte{255, byte(len(commit))}, commit...))
+	if !r.CommitTime().Equal(at) {
+		t.Fatal("short: ", r.CommitTime())
+	}
+
+	// XLR_BLOCK_ID_DATA_LONG
+	long := bytes.Repeat([]byte{9}, 300)
+	copy(long, commit)
+	d := []byte{254, 0, 0, 0, 0}
+	le.PutUint32(d[1:], uint32(len(long)))
+	r = testRecord(RmgrTx, 0, append(d, long...))
+	if !bytes.Equal(r.MainData(), long) || !r.CommitTime().Equal(at) {
+		t.Fatal("long: ", len(r.MainData()), r.CommitTime())
+	}
+
+	// origin, toplevel xid and a block with data before the main data
+	d = []byte{
+		253, 1, 0, // XLR_BLOCK_ID_ORIGIN
+		252, 7, 0, 0, 0, // XLR_BLOCK_ID_TOPLEVEL_XID
+		0, 0x20, 3, 0, // block 0, BKPBLOCK_HAS_DATA, 3 bytes
+		0x7f, 6, 0, 0, 5, 0, 0, 0, 100, 0, 0, 0, // tablespace 1663, db 5, rel 100
+		42, 0, 0, 0, // block number
+		255, byte(len(commit)),
+		1, 2, 3, // block data
+	}
+	r = testRecord(RmgrTx, 0, append(d, commit...))
+	bb, ok := r.Blocks()
+	if !ok || len(bb) != 1 || bb[0] != (BlockRef{Tblspc: 1663, DB: 5, Rel: 100, Block: 42}) {
+		t.Fatal(bb, ok)
+	}
+	if !r.CommitTime().Equal(at) {
+		t.Fatal("origin, xid: ", r.CommitTime())
+	}
+
+	// no main data
+	r = testRecord(RmgrHeap, 0, append([]byte{0, 0, 0, 0}, d[12:28]...))
+	if bb, ok := r.Blocks(); !ok || len(bb) != 1 || len(r.MainData()) != 0 {
+		t.Fatal(bb, ok)
+	}
+
+	// malformed
+	r = testRecord(RmgrHeap, 0, []byte{200, 1, 2})
+	if _, ok := r.Blocks(); ok {
+		t.Fatal("malformed headers accepted")
+	}
+}
+
+func TestRecordBlockImage(t *testing.T) {
+	rel := []byte{
+		0x7f, 6, 0, 0, 5, 0, 0, 0, 100, 0, 0, 0, // tablespace 1663, db 5, rel 100
+		42, 0, 0, 0, // block number
+	}
+	image := func(bimgInfo byte, compressed bool) []byte {
+		d := []byte{
+			0, 0x10, 0, 0, // block 0, BKPBLOCK_HAS_IMAGE, no data
+			8, 0, 0x40, 0, bimgInfo, // 8 bytes image, hole at 64
+		}
+		if compressed {
+			d = append(d, 0x80, 0x1f) // hole length
+		}
+		d = append(d, rel...)
+		return append(d, 1, 2, 3, 4, 5, 6, 7, 8)
+	}
+	want := BlockRef{Tblspc: 1663, DB: 5, Rel: 100, Block: 42}
+
+	for _, c := range []struct {
+		bimgInfo   byte
+		compressed bool
+	}{
+		{0x00, false},
+		{0x01, false}, // BKPIMAGE_HAS_HOLE
+		{0x02, false}, // BKPIMAGE_IS_COMPRESSED
+		{0x03, true},
+	} {
+		r := testRecord(RmgrHeap, 0, image(c.bimgInfo, c.compressed))
+		bb, ok := r.Blocks()
+		if !ok || len(bb) != 1 || bb[0] != want {
+			t.Fatalf("bimg_info %x: %v %v", c.bimgInfo, bb, ok)
+		}
+	}
+}
@@ -27,11 +27,13 @@ func (a Agent) Query(opts *QueryOpts) error {
 	}
 
 	a.Recover(&RecoverOpts{
-		Target: opts.Target,
-		Dir:    dir,
+		Target:        opts.Target,
+		Dir:           dir,
+		TablespaceDir: dir + ".tblspc", // not in dir, restoring cleans that up
 	})
 
 	defer os.RemoveAll(dir)
+	defer os.RemoveAll(dir + ".tblspc")
 
 	os.Remove(dir + "/recovery.conf")
 	ioutil.WriteFile(dir+"/pg_hba.conf", []byte(`local all all trust`), 0700)
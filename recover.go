@@ -2,6 +2,7 @@ package main
 
 import (
 	"archive/tar"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	"./pgwal"
@@ -20,6 +22,29 @@ type RecoverOpts struct {
 	Dir      string
 	Target   string // "0/123456:5432"
 	Timeline int
+
+	TablespaceMapping tablespaceMapping // old location -> new
+	TablespaceDir     string            // for unmapped tablespaces, by oid, instead of their location
+}
+
+// tablespaceMapping is the repeatable old=new recover flag
+type tablespaceMapping map[string]string
+
+func (m tablespaceMapping) String() string {
+	var l []string
+	for o, n := range m {
+		l = append(l, o+"="+n)
+	}
+	return strings.Join(l, ",")
+}
+
+func (m tablespaceMapping) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i < 0 || !filepath.IsAbs(s[:i]) || !filepath.IsAbs(s[i+1:]) {
+		return errors.New("want old=new, both absolute")
+	}
+	m[filepath.Clean(s[:i])] = filepath.Clean(s[i+1:])
+	return nil
 }
 
 func (a Agent) Recover(opts *RecoverOpts) {
@@ -31,24 +56,26 @@ func (a Agent) Recover(opts *RecoverOpts) {
 	lsn := uint64(0xffffffffffff) // XXX: parse opts.Target
 	//txID := uint64(999999)
 
-	files, err := a.store.List()
-	if err != nil {
-		log.Fatal(err)
-	}
-
+	var baseName string
 	var baseLSN uint64
 	var baseTs int64
-	var baseTimeline int
-	for _, f := range files {
+	err := a.store.List("", func(f *StoreFile) error {
 		var lsn0 uint64
 		var timeline0 int
 		var ts0 int64
 		fmt.Sscanf(f.Name, "%012x.%x.%x.", &lsn0, &timeline0, &ts0)
-		if lsn0 > 0 && lsn0 <= lsn && timeline0 <= opts.Timeline && strings.HasSuffix(f.Name, ".base") {
+		if lsn0 > lsn {
+			return errStopList
+		}
+		if lsn0 > 0 && (opts.Timeline == 0 || timeline0 <= opts.Timeline) && strings.HasSuffix(f.Name, ".base") {
+			baseName = f.Name
 			baseLSN = lsn0
-			baseTimeline = timeline0
 			baseTs = ts0
 		}
+		return nil
+	})
+	if err != nil && err != errStopList {
+		log.Fatal(err)
 	}
 
 	if baseLSN == 0 {
@@ -66,55 +93,105 @@ func (a Agent) Recover(opts *RecoverOpts) {
 		opts.Dir = opts.Dir + "/"
 	}
 
-	r := &multiPartReader{
-		Store: a.store,
-		Name:  fmt.Sprintf("%012x.%x.%x.base", baseLSN, baseTimeline, baseTs),
+	// an incremental base is restored over its parents, the full base first
+	chain, err := a.baseChain(baseName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	m, err := a.readManifest(chain[len(chain)-1])
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	tr := tar.NewReader(r)
-
-	for {
-		th, err := tr.Next()
-		if err == io.EOF {
-			break
-		} else if err != nil {
+	// other tablespaces go to their original location unless mapped
+	locations := map[uint32]string{}
+	for _, ts := range m.Tablespaces {
+		loc := ts.Location
+		if n, ok := opts.TablespaceMapping[filepath.Clean(loc)]; ok {
+			loc = n
+		} else if opts.TablespaceDir != "" {
+			loc = filepath.Join(opts.TablespaceDir, fmt.Sprint(ts.OID))
+		}
+		names, err := readDirNames(loc)
+		if err == nil && len(names) > 0 {
+			log.Fatal("tablespace ", ts.OID, " location ", loc, " is not empty, see -tablespace-mapping")
+		}
+		err = os.MkdirAll(loc, 0700)
+		if err != nil {
 			log.Fatal(err)
 		}
+		log.Print("pgbackup: tablespace ", ts.OID, " in ", loc)
+		locations[ts.OID] = loc
+	}
 
-		fn := opts.Dir + th.Name
-		if th.Typeflag != tar.TypeReg {
-			if th.Typeflag == tar.TypeDir {
-				os.Mkdir(fn, 0700)
-			}
-			continue
+	for i, name := range chain {
+		if len(chain) > 1 {
+			log.Print("pgbackup: restoring base ", name, " (", i+1, "/", len(chain), ")")
 		}
-
-		h, err := os.Create(fn)
+		err = a.restoreBase(opts.Dir, name, i > 0)
 		if err != nil {
-			h.Close()
 			log.Fatal(err)
 		}
-		_, err = io.Copy(h, tr)
+		m, err := a.readManifest(name)
 		if err != nil {
-			h.Close()
 			log.Fatal(err)
 		}
-		h.Close()
+		for _, ts := range m.Tablespaces {
+			if loc, ok := locations[ts.OID]; ok {
+				err = a.restoreBase(loc, fmt.Sprintf("%s.tblspc.%d", name, ts.OID), i > 0)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+		}
 	}
 
+	err = linkTablespaces(opts.Dir, locations)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// latest replays all wal there is, up to the newest partial segment.
+	// Without a target postgres promotes rather than shutting down at the
+	// end, it is stopped once it renamed recovery.conf to recovery.done.
+	target := "recovery_target='immediate'\n"
+	if opts.Target == "latest" {
+		target = ""
+	}
 	ourPath, _ := filepath.Abs(os.Args[0])
+	if a.Name != "" {
+		ourPath = "PGBACKUP_CLUSTER=" + a.Name + " " + ourPath
+	}
 	ioutil.WriteFile(opts.Dir+"recovery.conf", []byte(`
 restore_command='`+ourPath+` restore_command "`+a.configFile+`" %f "%p"'
-recovery_target='immediate'
-recovery_target_timeline='latest'
+`+target+`recovery_target_timeline='latest'
 recovery_target_action='shutdown'
 `), 0700)
 
 	dir, _ := filepath.Abs(opts.Dir)
+	os.Remove(filepath.Join(dir, "recovery.done")) // of an earlier recovery, in the base
 	cmd := exec.Command("/usr/lib/postgresql/9.5/bin/postgres", "-D", dir, "-h", "", "-k", ".")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	err = cmd.Start()
+	if err != nil {
+		log.Fatal(err)
+	}
+	doneC := make(chan error, 1)
+	go func() {
+		doneC <- cmd.Wait()
+	}()
+	for {
+		select {
+		case err = <-doneC:
+		case <-time.After(time.Second):
+			if _, err := os.Stat(filepath.Join(dir, "recovery.done")); target == "" && err == nil {
+				cmd.Process.Signal(syscall.SIGINT) // fast shutdown
+			}
+			continue
+		}
+		break
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -127,7 +204,8 @@ recovery_target_action='shutdown'
 func (a Agent) RestoreCommand(segment, to string) error {
 
 	if strings.HasSuffix(segment, ".history") {
-		return nil
+		// postgres probes for newer timelines, a missing one is an error
+		return a.restoreFile("timeline."+segment, to)
 	}
 
 	var timeline, logical, physical uint64
@@ -143,10 +221,38 @@ func (a Agent) RestoreCommand(segment, to string) error {
 	name := fmt.Sprintf("%012x.%x.wal", lsn, timeline)
 	log.Print("pgbackup: get segment @", pgwal.LSN(lsn))
 
+	//log.Print("restore timeline=", timeline, " lsn=", fmt.Sprintf("%x", lsn), " n=", n)
+	err := a.restoreFile(name, to)
+	if err == nil {
+		return nil
+	}
+
+	// the segment isn't complete, replay what the newest partial has
+	var partial string
+	a.store.List(fmt.Sprintf("%012x.%x.", lsn, timeline), func(f *StoreFile) error {
+		if strings.HasSuffix(f.Name, ".partial") {
+			partial = f.Name // longest last
+		}
+		return nil
+	})
+	if partial == "" {
+		return err
+	}
+	log.Print("pgbackup: using partial segment ", partial)
+	err = a.restoreFile(partial, to)
+	if err != nil {
+		return err
+	}
+	// postgres wants whole segments, the zeros end the wal
+	return os.Truncate(to, walSegmentSize)
+}
+
+func (a Agent) restoreFile(name, to string) error {
 	r, err := a.store.Download(name)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
 
 	f, err := os.Create(to)
 	if err != nil {
@@ -154,50 +260,176 @@ func (a Agent) RestoreCommand(segment, to string) error {
 	}
 
 	_, err = io.Copy(f, r)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
 	if err != nil {
-		return err
+		os.Remove(to)
 	}
-	f.Close()
+	return err
+}
 
-	//log.Print("restore timeline=", timeline, " lsn=", fmt.Sprintf("%x", lsn), " n=", n)
+// linkTablespaces points the data directory at the restored tablespaces,
+// with pg_tblspc symlinks or, for a base taken with base-tablespace-map,
+// in the tablespace_map postgres creates them from
+func linkTablespaces(dir string, locations map[uint32]string) error {
+	tsMap := filepath.Join(dir, "tablespace_map")
+	if _, err := os.Stat(tsMap); err == nil {
+		var b bytes.Buffer
+		for oid, loc := range locations {
+			fmt.Fprintf(&b, "%d %s\n", oid, loc)
+		}
+		return ioutil.WriteFile(tsMap, b.Bytes(), 0600)
+	}
+
+	for oid, loc := range locations {
+		link := filepath.Join(dir, "pg_tblspc", fmt.Sprint(oid))
+		os.Remove(link)
+		err := os.Symlink(loc, link)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// restoreBase extracts base name into dir. Over the bases it builds on, an
+// incremental base patches the changed blocks and removes the files it
+// doesn't have.
+func (a *Agent) restoreBase(dir, name string, incremental bool) error {
+	mpr := &multiPartReader{Store: a.store, Name: name}
+	if strings.HasSuffix(name, ".base") {
+		m, err := a.readManifest(name)
+		if err != nil {
+			return err
+		}
+		mpr.Tail = m.tail
+	}
+	tr := tar.NewReader(mpr)
+	seen := map[string]bool{}
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		fn := filepath.Join(dir, th.Name)
+		seen[fn] = true
+		if th.Typeflag != tar.TypeReg {
+			if th.Typeflag == tar.TypeDir {
+				os.Mkdir(fn, 0700)
+			}
+			continue
+		}
+
+		var h *os.File
+		if th.PAXRecords[paxIncremental] != "" {
+			// new segments of relations grown since the parent too
+			h, err = os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0600)
+			if err == nil {
+				err = applyIncremental(h, tr)
+			}
+		} else {
+			h, err = os.Create(fn)
+			if err == nil {
+				_, err = io.Copy(h, tr)
+			}
+		}
+		if h != nil {
+			if err1 := h.Close(); err == nil {
+				err = err1
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", th.Name, err)
+		}
+	}
+
+	if !incremental {
+		return nil
+	}
+	// dropped since the parent
+	return filepath.Walk(dir, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() && !seen[fn] {
+			return os.Remove(fn)
+		}
+		return nil
+	})
+}
+
+// multiPartReader reads the parts of a base in order
 type multiPartReader struct {
 	Store Store
 	Name  string
-	n     int
+	Tail  bool     // the name object is the last part
+	parts []string // nil until listed
 	r     io.ReadCloser
 }
 
 func (mpr *multiPartReader) Read(d []byte) (int, error) {
-
-	var o int
+	if mpr.parts == nil {
+		err := mpr.list()
+		if err != nil {
+			return 0, err
+		}
+	}
 	for {
 		if mpr.r != nil {
 			n, err := mpr.r.Read(d)
-			// XXX: .Close when appropriate?
 			if err != io.EOF {
-				return o + n, err
+				return n, err
 			}
-			o += n
-			d = d[n:]
-		}
-		if mpr.n == -1 {
+			mpr.r.Close()
 			mpr.r = nil
-			return o, io.EOF
+			if n > 0 {
+				return n, nil
+			}
+		}
+		if len(mpr.parts) == 0 {
+			return 0, io.EOF
 		}
 		// switch to next reader
 		var err error
-		mpr.r, err = mpr.Store.Download(fmt.Sprintf("%s.part%x", mpr.Name, mpr.n))
-		mpr.n++
+		mpr.r, err = mpr.Store.Download(mpr.parts[0])
 		if err != nil {
-			// this was the last part
-			mpr.r, err = mpr.Store.Download(mpr.Name)
-			if err != nil {
-				return o, err
-			}
-			mpr.n = -1
+			return 0, err
+		}
+		mpr.parts = mpr.parts[1:]
+	}
+}
+
+// list finds the parts, name.partN in hex, which don't sort by name
+func (mpr *multiPartReader) list() error {
+	byN := map[int]string{}
+	err := mpr.Store.List(mpr.Name+".part", func(f *StoreFile) error {
+		var n int
+		_, err := fmt.Sscanf(f.Name[len(mpr.Name+".part"):], "%x", &n)
+		if err == nil {
+			byN[n] = f.Name
 		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	mpr.parts = []string{}
+	for n := 0; n < len(byN); n++ {
+		p, ok := byN[n]
+		if !ok {
+			return fmt.Errorf("base %s: part %x missing", mpr.Name, n)
+		}
+		mpr.parts = append(mpr.parts, p)
+	}
+	if mpr.Tail {
+		mpr.parts = append(mpr.parts, mpr.Name)
 	}
+	if len(mpr.parts) == 0 {
+		return fmt.Errorf("base %s: no parts", mpr.Name)
+	}
+	return nil
 }
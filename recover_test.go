@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTar(files map[string][]byte) []byte {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	tw.WriteHeader(&tar.Header{Name: "base", Typeflag: tar.TypeDir, Mode: 0700})
+	tw.WriteHeader(&tar.Header{Name: "base/5", Typeflag: tar.TypeDir, Mode: 0700})
+	for n, d := range files {
+		tw.WriteHeader(&tar.Header{Name: n, Typeflag: tar.TypeReg, Size: int64(len(d)), Mode: 0600})
+		tw.Write(d)
+	}
+	tw.Close()
+	return b.Bytes()
+}
+
+// testFileStore returns a store in a temporary dir, removed with the test
+func testFileStore(t *testing.T) (Store, string) {
+	tmp, err := ioutil.TempDir("", "pgbackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tmp) })
+	u, _ := url.Parse("file://" + filepath.Join(tmp, "store"))
+	fs, err := newFileStore(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs, tmp
+}
+
+// bases of before manifests keep the last chunk of the tar in the marker
+func TestRestoreLegacyBase(t *testing.T) {
+	fs, tmp := testFileStore(t)
+	a := &Agent{store: fs}
+
+	rel := bytes.Repeat([]byte{7}, 3*blockSize)
+	full := testTar(map[string][]byte{"base/5/100": rel, "PG_VERSION": []byte("9.5")})
+	fs.Upload("000001000000.1.1.base.part0", bytes.NewReader(full[:5000]))
+	fs.Upload("000001000000.1.1.base.part1", bytes.NewReader(full[5000:20000]))
+	fs.Upload("000001000000.1.1.base", bytes.NewReader(full[20000:]))
+	// small enough for the marker alone
+	fs.Upload("000002000000.1.2.base", bytes.NewReader(full))
+
+	for _, name := range []string{"000001000000.1.1.base", "000002000000.1.2.base"} {
+		chain, err := a.baseChain(name)
+		if err != nil || len(chain) != 1 {
+			t.Fatal(name, chain, err)
+		}
+		dir := filepath.Join(tmp, "data", name)
+		os.MkdirAll(dir, 0700)
+		err = a.restoreBase(dir, name, false)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		got, _ := ioutil.ReadFile(filepath.Join(dir, "base/5/100"))
+		if !bytes.Equal(got, rel) {
+			t.Fatal(name, "restored ", len(got), " bytes")
+		}
+	}
+
+	// retention goes by them like by other full bases
+	err := a.prune(time.Unix(3, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	fs.List("", func(f *StoreFile) error {
+		names = append(names, f.Name)
+		return nil
+	})
+	if len(names) != 1 || names[0] != "000002000000.1.2.base" {
+		t.Fatal(names)
+	}
+}
+
+// an incremental base restored over its parent gives the data directory at
+// its start
+func TestRestoreIncremental(t *testing.T) {
+	fs, tmp := testFileStore(t)
+	a := &Agent{store: fs}
+
+	blocks := func(n int, b byte) []byte {
+		d := make([]byte, n*blockSize)
+		for i := range d {
+			d[i] = b + byte(i/blockSize)
+		}
+		return d
+	}
+	v1 := map[string][]byte{
+		"PG_VERSION":     []byte("9.5"),
+		"base/5/100":     blocks(3, 10),
+		"base/5/100_fsm": blocks(1, 20),
+		"base/5/101":     blocks(2, 30),
+		"base/5/102":     blocks(1, 40),
+	}
+	v2 := map[string][]byte{
+		"PG_VERSION":     v1["PG_VERSION"],
+		"base/5/100":     append(append([]byte{}, v1["base/5/100"]...), blocks(1, 50)...),
+		"base/5/100_fsm": blocks(1, 60),
+		"base/5/101":     v1["base/5/101"][:blockSize], // truncated
+		"base/5/103":     blocks(2, 70),                // new, 102 dropped
+		"base/5/100.1":   blocks(1, 90),                // grown past 1GB
+	}
+	copy(v2["base/5/100"][blockSize:], blocks(1, 80)) // changed
+	changed := make([]uint64, relSegBlocks/64+1)
+	changed[0] = 1<<1 | 1<<3
+	changed[relSegBlocks/64] = 1
+	g := &blockGen{
+		blocks: map[relKey][]uint64{{1663, 5, 100}: changed},
+		rels:   map[relKey]bool{{1663, 5, 103}: true},
+		dbs:    map[relKey]bool{},
+	}
+
+	full := "000001000000.1.1.base"
+	fs.Upload(full+".part0", bytes.NewReader(testTar(v1)))
+	fs.Upload(full, bytes.NewReader(nil))
+	var incr bytes.Buffer
+	err := filterIncremental(bytes.NewReader(testTar(v2)), &incr, g, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if incr.Len() > 8*blockSize {
+		t.Fatal("incremental tar of ", incr.Len(), " bytes")
+	}
+	name := incrementalBaseName(0x2000000, 1, 2, 0x1000000)
+	fs.Upload(name+".part0", &incr)
+	fs.Upload(name, strings.NewReader(`{"parent":"`+full+`","incremental":true,"chain":1}`))
+
+	chain, err := a.baseChain(name)
+	if err != nil || len(chain) != 2 || chain[0] != full {
+		t.Fatal(chain, err)
+	}
+	dir := filepath.Join(tmp, "data")
+	os.MkdirAll(dir, 0700)
+	for i, n := range chain {
+		err = a.restoreBase(dir, n, i > 0)
+		if err != nil {
+			t.Fatal(n, err)
+		}
+	}
+
+	got := map[string][]byte{}
+	filepath.Walk(dir, func(fn string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			got[fn[len(dir)+1:]], err = ioutil.ReadFile(fn)
+		}
+		return err
+	})
+	if len(got) != len(v2) {
+		t.Fatal("restored ", len(got), " files")
+	}
+	for fn, d := range v2 {
+		if !bytes.Equal(got[fn], d) {
+			t.Fatal(fn, ": restored ", len(got[fn]), " bytes")
+		}
+	}
+}
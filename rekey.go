@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+)
+
+type RekeyOpts struct {
+	NewKey bool
+}
+
+// Rekey re-encrypts every object not yet encrypted with the active key.
+// Objects are checked one by one, so an interrupted run just continues
+// where it left off when started again.
+func (a *Agent) Rekey(opts *RekeyOpts) {
+
+	if opts.NewKey && a.EncryptPublicKey != "" {
+		log.Fatal("rekey: pgbackup.conf has an encrypt-public-key, use '", os.Args[0], " keygen' for a new key pair")
+	}
+
+	if opts.NewKey {
+		var key [32]byte
+		_, err := rand.Read(key[:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		id := 1
+		for id0 := range a.EncryptKeys {
+			if id0 >= id {
+				id = id0 + 1
+			}
+		}
+		if a.EncryptKeys == nil {
+			a.EncryptKeys = map[int]string{}
+		}
+		a.EncryptKeys[id], err = a.encodeKey(keyLabel(id), key[:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		a.EncryptKeyID = id
+
+		// the key must be safe before anything is encrypted with it
+		err = a.writeConfig(a.configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Print("rekey: added encrypt key ", id, " to ", a.configFile)
+		log.Print("rekey: restart the agent to use it for new backups")
+
+		keys, err := a.keyring()
+		if err != nil {
+			log.Fatal(err)
+		}
+		cs := a.store.(*cryptStore)
+		cs.Keys = keys
+		cs.KeyID = id
+	}
+
+	cs := a.store.(*cryptStore)
+	var n, done int
+	err := cs.Store.List("", func(f *StoreFile) error {
+		n++
+		key, err := cs.ObjectKey(f.Name)
+		if err != nil {
+			return err
+		}
+		if key == cs.ActiveKey() {
+			return nil
+		}
+
+		r, err := cs.Download(f.Name)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		// the upload fails, leaving the object as it was, if the download
+		// doesn't authenticate completely
+		err = cs.Upload(f.Name, r)
+		if err != nil {
+			return err
+		}
+		done++
+		return nil
+	})
+	if err != nil {
+		log.Fatal("rekey: ", err, " (run again to continue)")
+	}
+
+	log.Print("rekey: ", done, " of ", n, " objects re-encrypted with ", cs.ActiveKey())
+	if len(a.EncryptKeys) > 0 {
+		log.Print("rekey: older keys can now be removed from ", a.configFile)
+	}
+}
+
+// Keygen prints a new key pair for encrypting to a public key. The public
+// key goes into pgbackup.conf on the database server, the private key is
+// only needed to recover and should be kept elsewhere.
+func (a *Agent) Keygen() {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("\"encrypt-public-key\": %q,\n", base64.StdEncoding.EncodeToString(key.PublicKey().Bytes()))
+	fmt.Printf("\"encrypt-private-key\": %q\n", base64.StdEncoding.EncodeToString(key.Bytes()))
+}
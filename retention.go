@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"./pgwal"
+)
+
+// Pruner enforces the retention window (in hours) by deleting base backups
+// and wal that are no longer needed to recover to any point within it.
+func (a *Agent) Pruner() error {
+	if a.Retention <= 0 {
+		<-a.exitC
+		return nil
+	}
+
+	pruneT := time.After(5 * time.Minute)
+	for {
+		select {
+		case <-a.exitC:
+			return nil
+		case <-pruneT:
+			err := a.prune(time.Now().Add(-time.Duration(a.Retention) * time.Hour))
+			if err != nil {
+				log.Print("retention: err=", err)
+			}
+			pruneT = time.After(time.Hour)
+		}
+	}
+}
+
+// prune deletes everything not needed to recover to points after since.
+//
+// The newest complete base taken at or before since covers the whole
+// window, so older bases, except those it builds on if incremental, and wal
+// before that base can go. Parts of bases that never completed are removed
+// once a newer base completed, partial segments once a longer partial or
+// the full segment is stored.
+func (a *Agent) prune(since time.Time) error {
+
+	type base struct {
+		name string
+		lsn  uint64
+		ts   time.Time
+	}
+
+	var bases []*base              // complete bases, in lsn order
+	var wals []string              // in lsn order
+	var partials []string          // in lsn order, longest last
+	parts := map[string][]string{} // base name -> part names
+	complete := map[string]bool{}
+	err := a.store.List("", func(f *StoreFile) error {
+		var lsn0 uint64
+		var timeline0 int
+		var ts0 int64
+		fmt.Sscanf(f.Name, "%012x.%x.%x.", &lsn0, &timeline0, &ts0)
+		if timeline0 == 0 {
+			return nil
+		}
+		if strings.HasSuffix(f.Name, ".wal") {
+			wals = append(wals, f.Name)
+		} else if strings.HasSuffix(f.Name, ".partial") {
+			partials = append(partials, f.Name)
+		} else if strings.HasSuffix(f.Name, ".base") && ts0 != 0 {
+			bases = append(bases, &base{name: f.Name, lsn: lsn0, ts: time.Unix(ts0, 0)})
+			complete[f.Name] = true
+		} else if i := strings.Index(f.Name, ".base."); i > 0 {
+			// name.partN and name.tblspc.OID.partN
+			n := f.Name[:i+len(".base")]
+			parts[n] = append(parts[n], f.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(bases) == 0 {
+		return nil // nothing recoverable yet, keep it all
+	}
+
+	keep := bases[0]
+	for _, b := range bases {
+		if b.ts.After(since) {
+			break
+		}
+		keep = b
+	}
+	newest := bases[len(bases)-1]
+
+	// an incremental base needs the bases it builds on, their names tell
+	// which, markers can't always be decrypted here
+	root := keep
+	for p := baseParentLSN(root.name); p != 0; p = baseParentLSN(root.name) {
+		var parent *base
+		for _, b := range bases {
+			if b.lsn == p && b.lsn < root.lsn {
+				parent = b
+			}
+		}
+		if parent == nil {
+			return fmt.Errorf("base %s: parent @%s missing", root.name, pgwal.LSN(p))
+		}
+		root = parent
+	}
+
+	var del []string
+	for _, b := range bases {
+		if b.lsn >= root.lsn {
+			break
+		}
+		// marker first, an interrupted prune then leaves orphaned parts
+		del = append(del, b.name)
+		del = append(del, parts[b.name]...)
+		delete(parts, b.name)
+	}
+	for n, ps := range parts {
+		var lsn0 uint64
+		fmt.Sscanf(n, "%012x.", &lsn0)
+		if lsn0 < newest.lsn && !complete[n] {
+			log.Print("retention: orphaned base ", n, " parts:", len(ps))
+			del = append(del, ps...)
+		}
+	}
+
+	// the segment holding the base start lsn is needed
+	walKeep := keep.lsn & ^uint64(walSegmentSize-1)
+	full := map[string]bool{}
+	for _, n := range wals {
+		var lsn0 uint64
+		var timeline0 int
+		fmt.Sscanf(n, "%012x.%x.", &lsn0, &timeline0)
+		full[fmt.Sprintf("%012x.%x", lsn0, timeline0)] = true
+		if lsn0 < walKeep {
+			del = append(del, n)
+		}
+	}
+	for i, n := range partials {
+		var lsn0 uint64
+		var timeline0 int
+		fmt.Sscanf(n, "%012x.%x.", &lsn0, &timeline0)
+		seg := fmt.Sprintf("%012x.%x", lsn0, timeline0)
+		if lsn0 < walKeep || full[seg] || (i+1 < len(partials) && strings.HasPrefix(partials[i+1], seg+".")) {
+			del = append(del, n)
+		}
+	}
+
+	if len(del) == 0 {
+		return nil
+	}
+	log.Print("retention: keeping base @", pgwal.LSN(keep.lsn), " (", keep.ts.UTC(), "), deleting ", len(del), " objects")
+	for _, n := range del {
+		err := a.store.Delete(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
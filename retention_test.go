@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the bases an incremental base builds on are kept, also with a public key
+// only when the agent can't read markers
+func TestPruneIncrementalChain(t *testing.T) {
+	fs, _ := testFileStore(t)
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &cryptStore{Store: fs, Public: key.PublicKey()}
+	a := &Agent{store: cs}
+
+	full := func(lsn uint64, ts int64) string {
+		return fmt.Sprintf("%012x.1.%x.base", lsn, ts)
+	}
+	names := []string{
+		full(0x1000000, 10),
+		full(0x2000000, 20),
+		incrementalBaseName(0x3000000, 1, 30, 0x2000000),
+		incrementalBaseName(0x4000000, 1, 40, 0x3000000),
+		full(0x5000000, 50),
+	}
+	for i, n := range names {
+		var m []byte
+		if p := baseParentLSN(n); p != 0 {
+			m = []byte(fmt.Sprintf(`{"parent":%q,"incremental":true,"chain":%d}`, names[i-1], i-1))
+		}
+		for _, o := range []string{n + ".part0", n + ".tblspc.16400.part0", n} {
+			err = cs.Upload(o, bytes.NewReader(m))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = cs.Upload(fmt.Sprintf("%012x.1.wal", 0x1000000*uint64(i+1)), bytes.NewReader(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the kept base at 0x4000000 builds on 0x3000000 and 0x2000000
+	err = a.prune(time.Unix(45, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	fs.List("", func(f *StoreFile) error {
+		if !strings.HasSuffix(f.Name, ".part0") {
+			got = append(got, f.Name)
+		}
+		return nil
+	})
+	want := append([]string{"000004000000.1.wal", "000005000000.1.wal"}, names[1:]...)
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal(got)
+	}
+}
@@ -2,58 +2,118 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
+// 10000 parts max per object, so objects up to 80GB
+const s3PartSize = 8 << 20
+
 type s3Store struct {
-	S3     *s3.S3
-	Bucket string
-	Prefix string
+	S3       *s3.S3
+	Uploader *s3manager.Uploader
+	Bucket   string
+	Prefix   string
 }
 
+// newS3Store accepts s3://[key:secret@]bucket/prefix with optional query
+// parameters for S3 compatible services, eg
+// s3://bucket/prefix?endpoint=minio.local:9000&path-style=true&tls=false
+//
+//	region     bucket region (default from env/profile, else eu-west-1)
+//	endpoint   host[:port] of a non-AWS endpoint
+//	path-style use bucket in path instead of hostname
+//	tls        set false to use plain http
+//	ca         file with CA certificates to trust for the endpoint
+//	profile    shared config profile when no key is in the url
+//
+// Without key:secret in the url, the standard AWS credential chain is used
+// (environment, shared profile, instance role).
 func newS3Store(u *url.URL) (*s3Store, error) {
-	awsKey := u.User.Username()
-	awsSecret, _ := u.User.Password()
-	awsSes, err := session.NewSession(&aws.Config{
-		Credentials: credentials.NewStaticCredentials(awsKey, awsSecret, ""),
-		Region:      aws.String("eu-west-1"),
-	})
+	cfg := aws.Config{}
+	opts := session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}
+
+	for k, v := range u.Query() {
+		var err error
+		switch k {
+		case "region":
+			cfg.Region = aws.String(v[0])
+		case "endpoint":
+			cfg.Endpoint = aws.String(v[0])
+		case "path-style":
+			var b bool
+			b, err = strconv.ParseBool(v[0])
+			cfg.S3ForcePathStyle = aws.Bool(b)
+		case "tls":
+			var b bool
+			b, err = strconv.ParseBool(v[0])
+			cfg.DisableSSL = aws.Bool(!b)
+		case "ca":
+			var ca []byte
+			ca, err = ioutil.ReadFile(v[0])
+			opts.CustomCABundle = bytes.NewReader(ca)
+		case "profile":
+			opts.Profile = v[0]
+		default:
+			err = errors.New("unknown option")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("s3: %s=%s: %s", k, v[0], err)
+		}
+	}
+
+	if u.User != nil {
+		awsKey := u.User.Username()
+		awsSecret, _ := u.User.Password()
+		cfg.Credentials = credentials.NewStaticCredentials(awsKey, awsSecret, "")
+	}
+
+	opts.Config = cfg
+	awsSes, err := session.NewSessionWithOptions(opts)
 	if err != nil {
 		return nil, err
 	}
-	pf := u.Path[1:]
-	if !strings.HasSuffix(pf, "/") {
+	if aws.StringValue(awsSes.Config.Region) == "" {
+		awsSes.Config.Region = aws.String("eu-west-1")
+	}
+
+	pf := strings.TrimPrefix(u.Path, "/")
+	if pf != "" && !strings.HasSuffix(pf, "/") {
 		pf += "/"
 	}
+	svc := s3.New(awsSes)
 	return &s3Store{
-		S3:     s3.New(awsSes),
+		S3: svc,
+		Uploader: s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+			// bodies are streamed in parts, this bounds memory per upload
+			u.PartSize = s3PartSize
+			u.Concurrency = 2
+		}),
 		Bucket: u.Host,
 		Prefix: pf,
 	}, nil
 }
 
 func (s s3Store) Upload(name string, body io.Reader) error {
-	rs, _ := body.(io.ReadSeeker)
-	if rs == nil {
-		buf := &bytes.Buffer{}
-		_, err := io.Copy(buf, body)
-		if err != nil {
-			return err
-		}
-		rs = bytes.NewReader(buf.Bytes())
-	}
-	_, err := s.S3.PutObject(&s3.PutObjectInput{
+	// small bodies become a single PutObject, larger ones a multipart upload
+	_, err := s.Uploader.Upload(&s3manager.UploadInput{
 		Bucket: aws.String(s.Bucket),
 		Key:    aws.String(s.Prefix + name),
-		Body:   rs,
+		Body:   body,
 	})
 	log.Print("s3: upload ", name)
 	return err
@@ -71,26 +131,45 @@ func (s s3Store) Download(name string) (io.ReadCloser, error) {
 	return o.Body, nil
 }
 
-func (s s3Store) List() ([]*StoreFile, error) {
-	log.Print("list bucket=", s.Bucket, " prefix=", s.Prefix)
-	ls, err := s.S3.ListObjects(&s3.ListObjectsInput{
+func (s s3Store) Delete(name string) error {
+	_, err := s.S3.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(s.Bucket),
-		Prefix: aws.String(s.Prefix),
+		Key:    aws.String(s.Prefix + name),
 	})
-	if err != nil {
-		return nil, err
-	}
+	log.Print("s3: delete ", name)
+	return err
+}
 
-	var fs []*StoreFile
-	for _, o := range ls.Contents {
-		k := *(o.Key)
-		if strings.HasPrefix(k, s.Prefix) {
-			k = k[len(s.Prefix):]
-			fs = append(fs, &StoreFile{Name: k, Size: int(*(o.Size))})
+func (s s3Store) List(prefix string, fn func(*StoreFile) error) error {
+	log.Print("list bucket=", s.Bucket, " prefix=", s.Prefix+prefix)
+
+	// ListObjects returns at most 1000 keys per call, in utf-8 binary order.
+	// Use v1 with a marker, some S3 compatible services lack ListObjectsV2.
+	var marker string
+	for {
+		ls, err := s.S3.ListObjects(&s3.ListObjectsInput{
+			Bucket: aws.String(s.Bucket),
+			Prefix: aws.String(s.Prefix + prefix),
+			Marker: aws.String(marker),
+		})
+		if err != nil {
+			return err
 		}
-	}
 
-	// todo: paginate, (sort?)
+		for _, o := range ls.Contents {
+			k := *(o.Key)
+			marker = k
+			if strings.HasPrefix(k, s.Prefix) {
+				k = k[len(s.Prefix):]
+				err = fn(&StoreFile{Name: k, Size: int(*(o.Size))})
+				if err != nil {
+					return err
+				}
+			}
+		}
 
-	return fs, nil
+		if !aws.BoolValue(ls.IsTruncated) || len(ls.Contents) == 0 {
+			return nil
+		}
+	}
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"./pg"
+)
+
+// baseDue returns why a new base backup is due, or "" if it isn't. Bases
+// are taken every base-interval hours or on the base-cron schedule, and
+// once more than base-wal-size MB of wal was written since the last base.
+// With base-window set, only within the window.
+func (a *Agent) baseDue(now, baseTime time.Time, walSize uint64) string {
+	now, baseTime = now.Local(), baseTime.Local()
+	if len(a.baseWindow) > 0 && !inWindows(a.baseWindow, now) {
+		return ""
+	}
+
+	if a.baseCron != nil {
+		if !a.baseCron.Next(baseTime).After(now) {
+			return "base-cron " + a.BaseCron
+		}
+	} else if a.BaseInterval > 0 {
+		if now.Sub(baseTime) > time.Duration(a.BaseInterval)*time.Hour {
+			return fmt.Sprint("base-interval ", a.BaseInterval, "h")
+		}
+	} else if a.BaseWALSize <= 0 && now.Sub(baseTime) > 24*time.Hour {
+		return "daily" // nothing configured
+	}
+
+	if a.BaseWALSize > 0 && walSize > uint64(a.BaseWALSize)<<20 {
+		return fmt.Sprint("base-wal-size ", a.BaseWALSize, "MB")
+	}
+	return ""
+}
+
+func (a *Agent) parseSchedule() error {
+	var err error
+	if a.BaseCron != "" {
+		a.baseCron, err = parseCron(a.BaseCron)
+		if err != nil {
+			return fmt.Errorf("base-cron: %s", err)
+		}
+	}
+	if a.BaseWindow != "" {
+		a.baseWindow, err = parseWindows(a.BaseWindow)
+		if err != nil {
+			return fmt.Errorf("base-window: %s", err)
+		}
+	}
+	if a.BaseMaxRate != 0 && (a.BaseMaxRate < 32 || a.BaseMaxRate > 1048576) {
+		return fmt.Errorf("base-max-rate: %d kB/s out of range 32-1048576", a.BaseMaxRate)
+	}
+	if a.BaseMaxRateWindow != "" {
+		a.baseRateWindow, err = parseWindows(a.BaseMaxRateWindow)
+		if err != nil {
+			return fmt.Errorf("base-max-rate-window: %s", err)
+		}
+	}
+	return nil
+}
+
+// baseBackupOpts returns the BASE_BACKUP options for a base started at
+// now. MAX_RATE holds for the whole backup, even once it runs past
+// base-max-rate-window, a base started outside is limited by the agent
+// once it runs into the window, see baseInfo.limit.
+func (a *Agent) baseBackupOpts(now time.Time) pg.BaseBackupOpts {
+	opts := pg.BaseBackupOpts{
+		Label:         a.BaseLabel,
+		Fast:          a.BaseFast,
+		TablespaceMap: a.BaseTablespaceMap,
+		Progress:      a.BaseProgress,
+	}
+	if opts.Label == "" {
+		opts.Label = "pgbackup"
+	}
+	if len(a.baseRateWindow) == 0 || inWindows(a.baseRateWindow, now.Local()) {
+		opts.MaxRate = a.BaseMaxRate
+	}
+	return opts
+}
+
+// cronSchedule is a crontab(5) schedule: minute hour day-of-month month
+// day-of-week, in local time
+type cronSchedule struct {
+	min, hour, dom, mon, dow uint64 // bit sets
+	domAny, dowAny           bool
+}
+
+func parseCron(s string) (*cronSchedule, error) {
+	f := strings.Fields(s)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("want 5 fields, got %q", s)
+	}
+	c := &cronSchedule{}
+	var err error
+	for i, r := range []struct {
+		set      *uint64
+		min, max int
+	}{{&c.min, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.mon, 1, 12}, {&c.dow, 0, 7}} {
+		*r.set, err = parseCronField(f[i], r.min, r.max)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is sunday too
+	}
+	c.domAny = f[2] == "*"
+	c.dowAny = f[4] == "*"
+	return c, nil
+}
+
+// parseCronField parses a list of *, n or n-m, each with an optional /step
+func parseCronField(s string, min, max int) (uint64, error) {
+	var set uint64
+	for _, p := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.IndexByte(p, '/'); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(p[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step in %q", s)
+			}
+			p = p[:i]
+		}
+		from, to := min, max
+		if p != "*" {
+			var err error
+			r := strings.SplitN(p, "-", 2)
+			from, err = strconv.Atoi(r[0])
+			if err != nil {
+				return 0, fmt.Errorf("bad value in %q", s)
+			}
+			to = from
+			if len(r) == 2 {
+				to, err = strconv.Atoi(r[1])
+				if err != nil {
+					return 0, fmt.Errorf("bad range in %q", s)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q out of range %d-%d", s, min, max)
+		}
+		for v := from; v <= to; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+// Next returns the first scheduled minute after t
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0) // no match, eg february 30
+	for t.Before(end) {
+		if c.mon&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !c.day(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if c.min&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return end
+}
+
+// day matches day of month or week, either if both are restricted
+func (c *cronSchedule) day(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// timeWindow is a daily window in minutes since midnight, local time. It
+// wraps around midnight if to is before from.
+type timeWindow struct {
+	from, to int
+}
+
+// parseWindows parses a comma separated list of "hh:mm-hh:mm"
+func parseWindows(s string) ([]timeWindow, error) {
+	var ws []timeWindow
+	for _, p := range strings.Split(s, ",") {
+		var h0, m0, h1, m1 int
+		_, err := fmt.Sscanf(strings.TrimSpace(p), "%d:%d-%d:%d", &h0, &m0, &h1, &m1)
+		if err != nil || !validTime(h0, m0) || !validTime(h1, m1) {
+			return nil, fmt.Errorf("want hh:mm-hh:mm, got %q", p)
+		}
+		ws = append(ws, timeWindow{from: h0*60 + m0, to: h1*60 + m1})
+	}
+	return ws, nil
+}
+
+// validTime returns whether h:m is a time of day, 24:00 being the end
+func validTime(h, m int) bool {
+	return h >= 0 && m >= 0 && m <= 59 && (h < 24 || h == 24 && m == 0)
+}
+
+func inWindows(ws []timeWindow, t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range ws {
+		if w.from <= w.to && m >= w.from && m < w.to {
+			return true
+		} else if w.from > w.to && (m >= w.from || m < w.to) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, s := range []string{
+		"* * * * *",
+		"0,30 */2 1-15 1-3,12 1-5",
+		"59 23 31 12 7",
+		"5-10/2 * * * 0",
+	} {
+		_, err := parseCron(s)
+		if err != nil {
+			t.Fatal(s, ": ", err)
+		}
+	}
+	for _, s := range []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"10-5 * * * *",
+		"a * * * *",
+		"1- * * * *",
+	} {
+		_, err := parseCron(s)
+		if err == nil {
+			t.Fatal(s, ": accepted")
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t0, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return t0
+	}
+	for _, c := range []struct {
+		cron, from, next string
+	}{
+		{"0 3 * * *", "2026-01-01 02:59", "2026-01-01 03:00"},
+		{"0 3 * * *", "2026-01-01 03:00", "2026-01-02 03:00"},
+		{"*/15 * * * *", "2026-01-01 10:07", "2026-01-01 10:15"},
+		{"*/15 * * * *", "2026-01-01 23:50", "2026-01-02 00:00"},
+		{"30 8,20 * * *", "2026-01-01 09:00", "2026-01-01 20:30"},
+		{"0 0 * * 1", "2026-01-01 00:00", "2026-01-05 00:00"},      // monday
+		{"0 0 * * 7", "2026-01-01 00:00", "2026-01-04 00:00"},      // 7 is sunday
+		{"0 0 15 * *", "2026-01-20 00:00", "2026-02-15 00:00"},     // day of month only
+		{"0 0 1 * 1", "2026-01-01 00:00", "2026-01-05 00:00"},      // 1st or monday
+		{"0 0 1 * 1", "2026-01-26 00:00", "2026-02-01 00:00"},      // the 1st is a sunday
+		{"0 0 1-7 * */7", "2026-01-08 00:00", "2026-01-11 00:00"},  // */7 restricts the day of week
+		{"0 12 * 3-4 1-5", "2026-02-27 13:00", "2026-03-02 12:00"}, // month range, weekdays
+		{"0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},     // leap day
+		{"0 0 30 2 *", "2026-01-01 00:00", "2031-01-01 00:01"},     // never
+		{"59 23 31 12 *", "2026-12-31 23:58", "2026-12-31 23:59"},  // last minute of the year
+		{"0 0 * * 0", "2026-12-31 12:00", "2027-01-03 00:00"},      // sunday, next year
+		{"0 6 * * *", "2026-01-01 05:59:30", "2026-01-01 06:00"},   // seconds
+		{"0 6 * * *", "2026-01-01 05:00", "2026-01-01 06:00"},      // next hour
+		{"0 */6 * * *", "2026-01-01 18:01", "2026-01-02 00:00"},    // hour step
+	} {
+		cs, err := parseCron(c.cron)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from, err := time.Parse("2006-01-02 15:04:05", c.from)
+		if err != nil {
+			from = at(c.from)
+		}
+		if next := cs.Next(from); !next.Equal(at(c.next)) {
+			t.Fatal(c.cron, " from ", c.from, ": ", next)
+		}
+	}
+}
+
+func TestParseWindows(t *testing.T) {
+	ws, err := parseWindows("22:00-06:00, 12:30-13:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		hm string
+		in bool
+	}{
+		{"21:59", false},
+		{"22:00", true},
+		{"00:00", true}, // wraps midnight
+		{"05:59", true},
+		{"06:00", false},
+		{"12:29", false},
+		{"12:30", true},
+		{"13:00", false},
+	} {
+		t0, _ := time.Parse("15:04", c.hm)
+		if inWindows(ws, t0) != c.in {
+			t.Fatal(c.hm, ": in ", !c.in)
+		}
+	}
+
+	ws, err = parseWindows("00:00-24:00")
+	if err != nil || !inWindows(ws, time.Date(2026, 1, 1, 23, 59, 0, 0, time.UTC)) {
+		t.Fatal("whole day: ", ws, err)
+	}
+	for _, s := range []string{"24:59-01:00", "01:00-24:01", "25:00-01:00", "01:60-02:00", "-1:00-02:00", "1-2", "01:00"} {
+		_, err := parseWindows(s)
+		if err == nil {
+			t.Fatal(s, ": accepted")
+		}
+	}
+}
@@ -4,8 +4,6 @@ import (
 	"bufio"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -15,12 +13,28 @@ import (
 	"./pg"
 )
 
-func (a *Agent) Setup() {
+type SetupOpts struct {
+	KeyProvider string
+}
+
+func (a *Agent) Setup(opts *SetupOpts) {
 
 	if _, err := os.Stat("pgbackup.conf"); !os.IsNotExist(err) {
 		log.Fatal("pgbackup.conf already exists\nDelete it if you want to create a new backup (deleting it may remove your private key and make existing backups unusable).")
 	}
 
+	// the kek has to be there before the key is wrapped with it
+	if opts.KeyProvider != "" && opts.KeyProvider != "inline" {
+		err := createKEKFile(opts.KeyProvider)
+		if err == nil {
+			a.KeyProvider = opts.KeyProvider
+			_, err = a.loadKEK()
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	var key [32]byte
 	_, err := rand.Read(key[:])
 	if err != nil {
@@ -146,7 +160,13 @@ func (a *Agent) Setup() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	a.EncryptKey = base64.StdEncoding.EncodeToString(key[:])
+	a.EncryptKey, err = a.encodeKey(keyLabel(0), key[:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if a.KeyProvider == "" {
+		log.Print("The key is stored unwrapped in pgbackup.conf, see '", os.Args[0], " wrap-keys' to move it to a key provider.")
+	}
 
 	// some sensible defaults:
 	a.WarnAt = "wal:900"
@@ -154,18 +174,11 @@ func (a *Agent) Setup() {
 	a.BaseInterval = 12
 	a.Rollover = 300
 
-	fh, err := os.Create("pgbackup.conf")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer fh.Close()
-	e := json.NewEncoder(fh)
-	e.SetIndent("", "\t")
-	err = e.Encode(a)
+	err = a.writeConfig("pgbackup.conf")
 	if err != nil {
 		log.Fatal(err)
 	}
-	p, _ := filepath.Abs(fh.Name())
+	p, _ := filepath.Abs("pgbackup.conf")
 	log.Print("Created ", p)
 	log.Print()
 	log.Print("To start the agent as current user:")
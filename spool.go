@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errExit = errors.New("exiting")
+
+// spool is a local directory holding objects until they are uploaded, so
+// a store outage or an agent restart does not lose them. Files are named
+// seq.name, the sequence keeps the order in which objects were queued.
+type spool struct {
+	Dir   string
+	Limit int64 // bytes, may be exceeded by the last object added
+
+	mu      sync.Mutex
+	seq     uint64
+	used    int64
+	queue   []*spoolFile
+	changeC chan bool // closed and replaced when the queue changes
+}
+
+type spoolFile struct {
+	Name string // object name
+	path string
+	size int64
+	busy bool // handed out by Next
+}
+
+// spoolDir defaults to a directory next to pgbackup.conf, or to
+// /var/lib/pgbackup for the installed service
+func (a *Agent) spoolDir() string {
+	if a.SpoolDir != "" {
+		return a.SpoolDir
+	} else if strings.HasPrefix(a.configFile, "/etc/") {
+		return "/var/lib/pgbackup/spool"
+	}
+	return filepath.Join(filepath.Dir(a.configFile), "pgbackup.spool")
+}
+
+func openSpool(dir string, limit int64) (*spool, error) {
+	if limit <= 0 {
+		limit = 1 << 30
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	sp := &spool{
+		Dir:     dir,
+		Limit:   limit,
+		changeC: make(chan bool),
+	}
+
+	// leftovers of writes interrupted by a crash
+	tmps, _ := filepath.Glob(filepath.Join(dir, ".spool-*"))
+	for _, n := range tmps {
+		os.Remove(n)
+	}
+
+	names, err := readDirNames(dir) // sorted, so in queue order
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		var seq uint64
+		i := strings.IndexByte(n, '.')
+		if _, err := fmt.Sscanf(n, "%016x.", &seq); err != nil || i < 0 {
+			continue
+		}
+		fi, err := os.Stat(filepath.Join(dir, n))
+		if err != nil {
+			return nil, err
+		}
+		sp.queue = append(sp.queue, &spoolFile{Name: n[i+1:], path: filepath.Join(dir, n), size: fi.Size()})
+		sp.used += fi.Size()
+		sp.seq = seq
+	}
+	if len(sp.queue) > 0 {
+		log.Print("spool: ", len(sp.queue), " objects (", sp.used>>20, "MB) left to upload in ", dir)
+	}
+	return sp, nil
+}
+
+// Put writes body to the spool and queues it for upload. It waits while
+// the spool is full, unless exitC is closed.
+func (sp *spool) Put(name string, body io.Reader, exitC <-chan bool) error {
+	for {
+		sp.mu.Lock()
+		full := sp.used > 0 && sp.used >= sp.Limit
+		changeC := sp.changeC
+		sp.mu.Unlock()
+		if !full {
+			break
+		}
+		select {
+		case <-exitC:
+			return errExit
+		case <-changeC:
+		}
+	}
+	return sp.Keep(name, body)
+}
+
+// Keep is Put without waiting, the spool may grow past its limit. For wal
+// with nowhere else to go once the uploader stopped.
+func (sp *spool) Keep(name string, body io.Reader) error {
+	fh, err := ioutil.TempFile(sp.Dir, ".spool-")
+	if err != nil {
+		return err
+	}
+	tmp := fh.Name()
+	size, err := io.Copy(fh, body)
+	if err == nil {
+		err = fh.Sync()
+	}
+	if err1 := fh.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.seq++
+	f := &spoolFile{
+		Name: name,
+		path: filepath.Join(sp.Dir, fmt.Sprintf("%016x.%s", sp.seq, name)),
+		size: size,
+	}
+	err = os.Rename(tmp, f.path)
+	if err == nil {
+		err = syncDir(sp.Dir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	sp.queue = append(sp.queue, f)
+	sp.used += size
+	sp.changed()
+	return nil
+}
+
+// Next waits for an object to upload and hands it out to the caller until
+// Remove or Release. Wal, partial or not, goes before anything else,
+// otherwise objects are handed out in queue order. An object is held back
+// while parts queued before it (name.partN) are not uploaded yet, so a base
+// is only marked complete once all its parts are stored.
+func (sp *spool) Next(exitC <-chan bool) (*spoolFile, error) {
+	for {
+		sp.mu.Lock()
+		f := sp.next()
+		if f != nil {
+			f.busy = true
+			sp.mu.Unlock()
+			return f, nil
+		}
+		changeC := sp.changeC
+		sp.mu.Unlock()
+		select {
+		case <-exitC:
+			return nil, errExit
+		case <-changeC:
+		}
+	}
+}
+
+func (sp *spool) next() *spoolFile {
+	var next *spoolFile
+	for i, f := range sp.queue {
+		if f.busy {
+			continue
+		}
+		if strings.HasSuffix(f.Name, ".wal") || strings.HasSuffix(f.Name, ".partial") {
+			return f
+		}
+		if next == nil && !sp.hasParts(f, i) {
+			next = f
+		}
+	}
+	return next
+}
+
+func (sp *spool) hasParts(f *spoolFile, i int) bool {
+	for _, f0 := range sp.queue[:i] {
+		if strings.HasPrefix(f0.Name, f.Name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Release puts an object handed out by Next back in the queue
+func (sp *spool) Release(f *spoolFile) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	f.busy = false
+	sp.changed()
+}
+
+func (sp *spool) changed() {
+	close(sp.changeC)
+	sp.changeC = make(chan bool)
+}
+
+// Open returns the spooled content of f
+func (sp *spool) Open(f *spoolFile) (io.ReadCloser, error) {
+	return os.Open(f.path)
+}
+
+// Remove drops an uploaded object from the spool
+func (sp *spool) Remove(f *spoolFile) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for i, f0 := range sp.queue {
+		if f0 == f {
+			sp.queue = append(sp.queue[:i], sp.queue[i+1:]...)
+			break
+		}
+	}
+	sp.used -= f.size
+	sp.changed()
+	return os.Remove(f.path)
+}
+
+// List calls fn for each queued object, in queue order
+func (sp *spool) List(fn func(*StoreFile) error) error {
+	sp.mu.Lock()
+	q := append([]*spoolFile{}, sp.queue...)
+	sp.mu.Unlock()
+	for _, f := range q {
+		err := fn(&StoreFile{Name: f.Name, Size: int(f.size)})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats returns the number and size of the queued objects
+func (sp *spool) Stats() (int, int64) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return len(sp.queue), sp.used
+}
+
+// backoff returns the delay before retry n (0 based): doubling from a
+// second up to max, with jitter so agents don't retry in lockstep
+func backoff(n int, max time.Duration) time.Duration {
+	d := max
+	if n < 30 && time.Second<<uint(n) < max {
+		d = time.Second << uint(n)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"./pgwal"
@@ -46,6 +51,14 @@ func (a Agent) Status() {
 	log.Print("         latest tx: ", res.TxID, " ", time.Since(time.Unix(0, res.TxTs*1e6)).Truncate(time.Second), " ago")
 	log.Print()
 
+	// from the agent on this host
+	if bs := a.readBaseStatus(); bs != nil {
+		log.Print("      base running: ", bs.Name)
+		log.Print("     base progress: ", baseProgress(bs.Read, bs.Size), " (", time.Since(time.Unix(bs.Time, 0)).Truncate(time.Second), " ago)")
+		log.Print("      base started: ", time.Since(time.Unix(bs.Start, 0)).Truncate(time.Second), " ago")
+		log.Print()
+	}
+
 	/*log.Print("      Tx at: ", txLsn, " timestamp: ", txTs)
 	log.Print(" WAL backup: ", walLsn,
 		"  lag: ", size(lsnDelta(txLsn, walLsn)),
@@ -56,3 +69,52 @@ func (a Agent) Status() {
 	log.Print(": ", base1Ts, ", ", base1Size)*/
 
 }
+
+// baseStatus is the running base backup, the agent keeps it in the spool
+// dir for status
+type baseStatus struct {
+	Name  string `json:"name"`
+	Start int64  `json:"start"`
+	Read  int64  `json:"read"`
+	Size  int64  `json:"size,omitempty"` // estimate
+	Time  int64  `json:"time"`           // of the update
+}
+
+func (a *Agent) baseStatusPath() string {
+	return filepath.Join(a.spoolDir(), ".base")
+}
+
+// writeBaseStatus records the progress of b, nil once it completed
+func (a *Agent) writeBaseStatus(b *baseInfo) {
+	if b == nil {
+		os.Remove(a.baseStatusPath())
+		return
+	}
+	d, _ := json.Marshal(&baseStatus{
+		Name:  b.Name,
+		Start: b.Time.Unix(),
+		Read:  atomic.LoadInt64(&b.read),
+		Size:  b.Size,
+		Time:  time.Now().Unix(),
+	})
+	tmp := a.baseStatusPath() + ".tmp"
+	err := ioutil.WriteFile(tmp, d, 0600)
+	if err == nil {
+		err = os.Rename(tmp, a.baseStatusPath())
+	}
+	if err != nil {
+		log.Print("baseBackup: status err=", err)
+	}
+}
+
+func (a *Agent) readBaseStatus() *baseStatus {
+	d, err := ioutil.ReadFile(a.baseStatusPath())
+	if err != nil {
+		return nil
+	}
+	bs := &baseStatus{}
+	if json.Unmarshal(d, bs) != nil {
+		return nil
+	}
+	return bs
+}
@@ -2,8 +2,15 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"./pgwal"
 )
 
 type StoreFile struct {
@@ -14,15 +21,28 @@ type StoreFile struct {
 type Store interface {
 	Upload(name string, body io.Reader) error
 	Download(name string) (io.ReadCloser, error)
-	List() ([]*StoreFile, error)
+
+	// List calls fn for each object starting with prefix, in name order.
+	// Object names start with a fixed width hex lsn, so name order is lsn
+	// order, except timeline.NAME.history which sort after all of them. An
+	// error returned by fn stops the listing and is returned.
+	List(prefix string, fn func(*StoreFile) error) error
+
+	// Delete removes an object, deleting a missing object is not an error
+	Delete(name string) error
 }
 
+// errStopList can be returned from a List callback to end the listing early
+var errStopList = errors.New("stop listing")
+
 func NewStore(u string) (Store, error) {
 	su, err := url.Parse(u)
 	if err != nil {
 		return nil, err
 	} else if su.Scheme == "s3" {
 		return newS3Store(su)
+	} else if su.Scheme == "file" {
+		return newFileStore(su)
 	}
 	return nil, errors.New("unknown scheme")
 }
@@ -32,17 +52,157 @@ type Upload struct {
 	Body io.Reader
 }
 
-func (a Agent) Uploader() error {
+// Uploader spools queued objects to disk and uploads them from there with
+// a pool of workers, retrying failed uploads until they succeed.
+func (a *Agent) Uploader() error {
+	n := a.UploadWorkers
+	if n <= 0 {
+		n = 4
+	}
+	sendC := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			sendC <- a.sendSpool()
+		}()
+	}
+	wait := func() error {
+		var err error
+		for i := 0; i < n; i++ {
+			if err0 := <-sendC; err == nil {
+				err = err0
+			}
+		}
+		return err
+	}
+
 	for {
 		select {
 		case <-a.exitC:
-			return nil
+			return wait()
+		case err := <-sendC:
+			return err
 		case u := <-a.uploadC:
-			err := a.store.Upload(u.Name, u.Body)
-			if err != nil {
-				// todo: retry
+			err := a.spool.Put(u.Name, u.Body, a.exitC)
+			if err == errExit {
+				return wait()
+			} else if err != nil {
 				return err
 			}
 		}
 	}
 }
+
+func (a *Agent) sendSpool() error {
+	for {
+		f, err := a.spool.Next(a.exitC)
+		if err == errExit {
+			return nil
+		}
+
+		for try := 0; ; try++ {
+			err = a.uploadSpooled(f)
+			if err == nil {
+				break
+			} else if err == errExit {
+				a.spool.Release(f)
+				return nil
+			}
+			d := backoff(try, 5*time.Minute)
+			log.Print("upload: ", f.Name, " failed (try ", try+1, "), retry in ", d.Truncate(time.Second), ": ", err)
+			select {
+			case <-a.exitC:
+				a.spool.Release(f)
+				return nil
+			case <-time.After(d):
+			}
+		}
+
+		err = a.spool.Remove(f)
+		if err != nil {
+			return err
+		}
+
+		var lsn uint64
+		var timeline int
+		fmt.Sscanf(f.Name, "%012x.%x.", &lsn, &timeline)
+		if strings.HasSuffix(f.Name, ".wal") && timeline != 0 && a.walStored.Done(lsn) {
+			log.Print("upload: wal stored up to ", pgwal.LSN(a.walStored.Safe()))
+			a.metrics.walStored(a.walStored.Safe())
+		}
+	}
+}
+
+// uploadSpooled uploads f within upload-workers and upload-rate, which
+// all clusters share. The rate applies to what the store sends, see
+// cryptStore.
+func (a *Agent) uploadSpooled(f *spoolFile) error {
+	if a.uploadSem != nil {
+		select {
+		case <-a.exitC:
+			return errExit
+		case a.uploadSem <- true:
+		}
+		defer func() {
+			<-a.uploadSem
+		}()
+	}
+
+	r, err := a.spool.Open(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// not the wait for the semaphore
+	start := time.Now()
+	err = a.store.Upload(f.Name, r)
+	a.metrics.upload(f.Name, time.Since(start), err)
+	return err
+}
+
+// walTracker follows the lsn up to which every wal segment is stored.
+// Segments are uploaded in parallel and can complete out of order.
+type walTracker struct {
+	mu   sync.Mutex
+	safe uint64          // all segments before are stored
+	done map[uint64]bool // stored segments after safe
+}
+
+// Reset restarts tracking at lsn, segments before it are known to be stored
+func (t *walTracker) Reset(lsn uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.safe = lsn
+	t.done = map[uint64]bool{}
+}
+
+// Seed restarts tracking at lsn with the segments known to be stored, the
+// safe position is the end of their contiguous run from lsn
+func (t *walTracker) Seed(lsn uint64, stored []uint64) {
+	t.Reset(lsn)
+	for _, s := range stored {
+		t.Done(s)
+	}
+}
+
+// Done records the segment at lsn as stored, it returns whether the safe
+// position advanced
+func (t *walTracker) Done(lsn uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if lsn < t.safe {
+		return false
+	}
+	t.done[lsn] = true
+	safe := t.safe
+	for t.done[t.safe] {
+		delete(t.done, t.safe)
+		t.safe += walSegmentSize
+	}
+	return t.safe != safe
+}
+
+func (t *walTracker) Safe() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.safe
+}
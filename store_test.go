@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestWALTrackerSeed(t *testing.T) {
+	seg := uint64(walSegmentSize)
+	for _, c := range []struct {
+		from   uint64
+		stored []uint64
+		safe   uint64
+	}{
+		{0, nil, 0},
+		{2 * seg, []uint64{seg, 2 * seg, 3 * seg}, 4 * seg},
+		{2 * seg, []uint64{2 * seg, 4 * seg}, 3 * seg}, // 3 is missing
+		{2 * seg, []uint64{seg, 3 * seg}, 2 * seg},     // the base segment is missing
+	} {
+		w := &walTracker{}
+		w.Seed(c.from, c.stored)
+		if w.Safe() != c.safe {
+			t.Fatal(c.from, c.stored, ": safe ", w.Safe())
+		}
+	}
+
+	// the missing segment is uploaded from the spool
+	w := &walTracker{}
+	w.Seed(2*seg, []uint64{2 * seg, 4 * seg, 5 * seg})
+	if !w.Done(3*seg) || w.Safe() != 6*seg {
+		t.Fatal("safe ", w.Safe())
+	}
+}
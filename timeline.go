@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"./pg"
+	"./pgwal"
+)
+
+// timelineHistory tells which wal of older timelines leads up to the
+// current timeline, from the server's timeline history file
+type timelineHistory struct {
+	Timeline int
+	End      map[int]uint64 // lsn where each ancestor timeline switched
+}
+
+// fetchHistory reads the history of timeline from the server and queues
+// it and those of its ancestors for upload as timeline.NAME.history,
+// restore_command serves them for recovery_target_timeline
+func (a *Agent) fetchHistory(conn *pg.Conn, timeline int) (*timelineHistory, error) {
+	h := &timelineHistory{Timeline: timeline, End: map[int]uint64{}}
+	if timeline <= 1 {
+		return h, nil // timeline 1 has no history
+	}
+
+	name, content, err := conn.TimelineHistory(timeline)
+	if err != nil {
+		return nil, err
+	}
+
+	// lines are: parent timeline, switch point, reason
+	s := bufio.NewScanner(bytes.NewReader(content))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 2 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		tl, err := strconv.Atoi(f[0])
+		if err != nil {
+			continue
+		}
+		lsn, err := pgwal.ParseLSN(f[1])
+		if err != nil {
+			continue
+		}
+		h.End[tl] = uint64(lsn)
+	}
+	log.Print("timeline: ", timeline, " history ", h.End)
+
+	// recovery follows the history files back from the target timeline,
+	// ancestors not stored yet are uploaded too
+	stored := map[string]bool{}
+	have := func(f *StoreFile) error {
+		stored[f.Name] = true
+		return nil
+	}
+	err = a.store.List("timeline.", have)
+	if err != nil {
+		return nil, err
+	}
+	a.spool.List(have)
+
+	uploads := []*Upload{{Name: "timeline." + name, Body: bytes.NewReader(content)}}
+	for tl := range h.End {
+		if tl <= 1 || stored[fmt.Sprintf("timeline.%08X.history", tl)] {
+			continue
+		}
+		name0, content0, err := conn.TimelineHistory(tl)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, &Upload{Name: "timeline." + name0, Body: bytes.NewReader(content0)})
+	}
+	for _, u := range uploads {
+		select {
+		case <-a.exitC:
+			return nil, errExit
+		case a.uploadC <- u:
+		}
+	}
+	return h, nil
+}
+
+// segment returns the timeline the wal segment at lsn is archived under:
+// the oldest timeline that ended after the segment, segments holding a
+// switch point belong to the next timeline
+func (h *timelineHistory) segment(lsn uint64) int {
+	tl := h.Timeline
+	for tl0, end := range h.End {
+		if tl0 < tl && lsn < end&^uint64(walSegmentSize-1) {
+			tl = tl0
+		}
+	}
+	return tl
+}
+
+// contains returns whether lsn on timeline is part of the history of the
+// current timeline
+func (h *timelineHistory) contains(timeline int, lsn uint64) bool {
+	if timeline == h.Timeline {
+		return true
+	}
+	end, ok := h.End[timeline]
+	return ok && lsn < end
+}
@@ -40,19 +40,32 @@ func (a Agent) TxSender() error {
 	for {
 		select {
 		case <-a.exitC:
+			if out.Len() > 0 {
+				flush()
+			}
 			return nil
 		case d := <-a.txLogC:
+			if d == nil {
+				// the stream restarted, the pump reset the block tracker
+				buf = nil
+				cont = pgwal.RecordCont{}
+				continue
+			}
 			buf = append(buf, d...)
+			var end uint64 // wal received up to
 			for len(buf) > 8192 {
 				p, err := pgwal.ParsePage(buf[:8192])
 				if err != nil {
 					log.Print("txstream: could not parse page: ", err)
 					buf = nil
 					cont = pgwal.RecordCont{}
+					a.blocks.Reset() // the changes have a gap
 					break
 				}
 				buf = buf[8192:]
+				end = uint64(p.LSN) + 8192
 				for _, r := range p.Records(&cont) {
+					a.blocks.Record(r)
 					if r.TxID == 0 {
 						continue
 					}
@@ -83,9 +96,37 @@ func (a Agent) TxSender() error {
 					flush()
 				}
 			}
+			if len(buf) > 0 {
+				end = a.peekBlocks(buf, cont)
+			}
+			if end > 0 {
+				a.blocks.Seen(end)
+			}
 
 		case <-flushT:
 			flush()
 		}
 	}
 }
+
+// peekBlocks tracks the complete records of the partial page in buf, so an
+// incremental base doesn't wait for the page to fill. It returns the lsn
+// the wal was received up to.
+func (a Agent) peekBlocks(buf []byte, cont pgwal.RecordCont) uint64 {
+	page := make([]byte, 8192)
+	copy(page, buf)
+	p, err := pgwal.ParsePage(page)
+	if err != nil {
+		return 0
+	}
+	end := uint64(p.LSN) + uint64(len(buf))
+
+	cont.Copy()
+	for _, r := range p.Records(&cont) {
+		// records crossing into the page also have its header
+		if uint64(r.LSN)+uint64(r.Len)+uint64(p.DataOffset) <= end {
+			a.blocks.Record(r)
+		}
+	}
+	return end
+}